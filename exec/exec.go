@@ -1,7 +1,9 @@
 package exec
 
 import (
+	"context"
 	"fmt"
+	"path"
 )
 
 type CommandExecutor interface {
@@ -9,8 +11,26 @@ type CommandExecutor interface {
 	RunCmd(io CommandInOut, dir, command string, arg ...string) error
 }
 
+// ContextExecutor is a CommandExecutor whose commands are bound to a context.
+// When the context is canceled or its deadline expires the command is killed
+// and the returned error wraps ErrCanceled or ErrTimeout.
+type ContextExecutor interface {
+	ExecuteCmdContext(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (string, error)
+	RunCmdContext(ctx context.Context, io CommandInOut, dir, command string, arg ...string) error
+}
+
 type Machine interface {
 	CommandExecutor
+	ContextExecutor
+	// RunCmdWithResult runs the command and returns its separated output, exit status and timing.
+	// Output is also copied to io.Out() and io.Err() when they are set. The result is returned
+	// together with the error whenever the command has been started.
+	RunCmdWithResult(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (*CommandResult, error)
+	// WithEnv returns a machine that runs its commands with the additional environment
+	// variables. The returned machine shares connections with the original one.
+	WithEnv(env Env) Machine
+	// Close releases connections held by the machine, it remains usable afterwards.
+	Close() error
 	User() string
 	Host() string
 	IpAddr() string
@@ -18,7 +38,11 @@ type Machine interface {
 }
 
 func Scp(io CommandInOut, sourceMachine Machine, sourceFile string, destinationMachine Machine, destinationFile string) error {
-	if destinationMachine.Host() == sourceMachine.Host() {
+	return ScpContext(context.Background(), io, sourceMachine, sourceFile, destinationMachine, destinationFile)
+}
+
+func ScpContext(ctx context.Context, io CommandInOut, sourceMachine Machine, sourceFile string, destinationMachine Machine, destinationFile string) error {
+	if isSameMachine(destinationMachine, sourceMachine) {
 		_, err := fmt.Fprintf(io.Out(), "Skipping, source and destination are the same: %s\n", destinationMachine.Host())
 		if err != nil {
 			return err
@@ -26,6 +50,11 @@ func Scp(io CommandInOut, sourceMachine Machine, sourceFile string, destinationM
 		return nil
 	}
 
+	if supportsFileTransfer(sourceMachine) && supportsFileTransfer(destinationMachine) {
+		logCommand(io, "localhost", "", "copy", transferLocation(sourceMachine, sourceFile), transferLocation(destinationMachine, destinationFile))
+		return Copy(ctx, sourceMachine, sourceFile, destinationMachine, destinationFile, TransferOptions{Log: io.Log()})
+	}
+
 	var execMachine Machine
 	if IsLocal(destinationMachine) {
 		execMachine = destinationMachine
@@ -35,45 +64,103 @@ func Scp(io CommandInOut, sourceMachine Machine, sourceFile string, destinationM
 
 	cmd := "scp"
 
+	// scp connects to the machine that is not executing it
+	var args []string
 	var source, destination string
 	if IsLocal(sourceMachine) || sourceMachine == execMachine {
 		source = sourceFile
 	} else {
-		source = fmt.Sprintf("%s@%s:%s", sourceMachine.User(), sourceMachine.IpAddr(), sourceFile)
+		source = remoteLocation(sourceMachine, sourceFile)
+		args = sshCommandArgs(sourceMachine, "-P")
 	}
 	if IsLocal(destinationMachine) || destinationMachine == execMachine {
 		destination = destinationFile
 	} else {
-		destination = fmt.Sprintf("%s@%s:%s", destinationMachine.User(), destinationMachine.IpAddr(), destinationFile)
+		destination = remoteLocation(destinationMachine, destinationFile)
+		args = sshCommandArgs(destinationMachine, "-P")
 	}
-	args := []string{source, destination}
+	args = append(args, source, destination)
 
-	return execMachine.RunCmd(io, "", cmd, args...)
+	return execMachine.RunCmdContext(ctx, io, "", cmd, args...)
+}
+
+// transferLocation formats a path on the machine the way scp does.
+func transferLocation(machine Machine, path string) string {
+	if IsLocal(machine) {
+		return path
+	}
+	return fmt.Sprintf("%s@%s:%s", machine.User(), machine.Host(), path)
 }
 
 func Rsync(io CommandInOut, sourceMachine Machine, sourceRootDir, sourceRelativeDir string, destinationMachine Machine, destinationRootDir string, options []string) error {
-	if destinationMachine.Host() == sourceMachine.Host() {
+	return RsyncContext(context.Background(), io, sourceMachine, sourceRootDir, sourceRelativeDir, destinationMachine, destinationRootDir, options)
+}
+
+// RsyncContext copies sourceRelativeDir of sourceRootDir into destinationRootDir. Any combination
+// of local and remote machines is supported, including two different directories on the same host.
+// The DefaultRsyncOptions are used, options starting with a dash are passed to rsync as they are
+// and all other options are exclude patterns. The port and SshCommandOptions of the remote machine
+// are appended to a remote shell given with -e or --rsh. See RsyncWithOptions for typed options.
+func RsyncContext(ctx context.Context, io CommandInOut, sourceMachine Machine, sourceRootDir, sourceRelativeDir string, destinationMachine Machine, destinationRootDir string, options []string) error {
+	return RsyncWithOptions(ctx, io, sourceMachine, sourceRootDir, sourceRelativeDir, destinationMachine, destinationRootDir, legacyRsyncOptions(options))
+}
+
+// rsync runs rsync on the machine chosen by buildRsyncCmdAndArgs. The result is returned only
+// when withResult is set and the transfer has not been skipped.
+func rsync(ctx context.Context, io CommandInOut, sourceMachine Machine, sourceRootDir, sourceRelativeDir string, destinationMachine Machine, destinationRootDir string, options []string, withResult bool) (*CommandResult, error) {
+	if isSameMachine(destinationMachine, sourceMachine) && path.Clean(sourceRootDir) == path.Clean(destinationRootDir) {
 		_, err := fmt.Fprintf(io.Out(), "Skipping, source and destination are the same: %s\n", destinationMachine.Host())
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return nil
+		return nil, nil
 	}
-	if IsLocal(destinationMachine) {
-		return fmt.Errorf("remote machine cannot be %s", destinationMachine.Host())
+	execMachine, cmd, args := buildRsyncCmdAndArgs(sourceMachine, sourceRootDir, sourceRelativeDir, destinationMachine, destinationRootDir, options)
+	if withResult {
+		return execMachine.RunCmdWithResult(ctx, io, "", cmd, args...)
 	}
-	cmd, args := buildRsyncCmdAndArgs(sourceRootDir, sourceRelativeDir, destinationMachine, destinationRootDir, options)
-	return sourceMachine.RunCmd(io, "", cmd, args...)
+	return nil, execMachine.RunCmdContext(ctx, io, "", cmd, args...)
 }
 
 func Mkdirs(machine Machine, io CommandInOut, dirName string) error {
-	return machine.RunCmd(io, "", "mkdir", "-p", dirName)
+	return MkdirsContext(context.Background(), machine, io, dirName)
+}
+
+func MkdirsContext(ctx context.Context, machine Machine, io CommandInOut, dirName string) error {
+	return machine.RunCmdContext(ctx, io, "", "mkdir", "-p", dirName)
 }
 
 func FileExists(machine Machine, io CommandInOut, fileName string) (bool, error) {
-	return fileTest(machine, io, fileName, "-f")
+	return FileExistsContext(context.Background(), machine, io, fileName)
+}
+
+func FileExistsContext(ctx context.Context, machine Machine, io CommandInOut, fileName string) (bool, error) {
+	return fileTest(ctx, machine, io, fileName, "-f")
 }
 
 func DirectoryExists(machine Machine, io CommandInOut, fileName string) (bool, error) {
-	return fileTest(machine, io, fileName, "-d")
+	return DirectoryExistsContext(context.Background(), machine, io, fileName)
+}
+
+func DirectoryExistsContext(ctx context.Context, machine Machine, io CommandInOut, fileName string) (bool, error) {
+	return fileTest(ctx, machine, io, fileName, "-d")
+}
+
+// RunShell runs script with /bin/sh on the machine. Unlike RunCmd, the script is interpreted
+// by the shell as it is: variables, globs, pipes and redirections are expanded.
+func RunShell(machine Machine, io CommandInOut, dir, script string) error {
+	return RunShellContext(context.Background(), machine, io, dir, script)
+}
+
+func RunShellContext(ctx context.Context, machine Machine, io CommandInOut, dir, script string) error {
+	return machine.RunCmdContext(ctx, io, dir, "sh", "-c", script)
+}
+
+// ExecuteShell runs script like RunShell and returns its combined output.
+func ExecuteShell(machine Machine, io CommandInOut, dir, script string) (string, error) {
+	return ExecuteShellContext(context.Background(), machine, io, dir, script)
+}
+
+func ExecuteShellContext(ctx context.Context, machine Machine, io CommandInOut, dir, script string) (string, error) {
+	return machine.ExecuteCmdContext(ctx, io, dir, "sh", "-c", script)
 }
@@ -0,0 +1,212 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const aggregateSeparator = "----------------"
+
+// AggregateOptions configures how FleetResults.Aggregate groups the machines.
+type AggregateOptions struct {
+	// ByExitCode puts failed machines with the same output but different exit codes in separate groups.
+	// Machines that have failed are never grouped with machines that have succeeded.
+	ByExitCode bool
+	// Stderr compares and shows standard error after standard output.
+	Stderr bool
+}
+
+// OutputGroup is a set of machines where the command has printed the same output.
+type OutputGroup struct {
+	Hosts  []string
+	Output string
+	// ExitCode is the exit code of all machines of the group, only set with AggregateOptions.ByExitCode.
+	ExitCode int
+	// Failed is set when the machines of the group have failed, see FleetResult.Success.
+	Failed bool
+	// Status describes machines where the command has not run, e.g. skipped or an error.
+	Status string
+}
+
+// OutputGroups are the groups of a fleet command, the largest first.
+type OutputGroups []OutputGroup
+
+// Aggregate groups the machines by identical output, like dshbak -c.
+func (rs FleetResults) Aggregate(options AggregateOptions) OutputGroups {
+	var groups OutputGroups
+	index := make(map[string]int)
+	for _, r := range rs {
+		group := OutputGroup{Hosts: []string{r.Host}}
+		switch {
+		case r.Skipped:
+			group.Status = "skipped"
+		case r.Result == nil:
+			group.Status = fmt.Sprint(r.Err)
+		default:
+			group.Output = string(r.Result.Stdout)
+			group.Failed = !r.Success()
+			if options.Stderr {
+				group.Output += string(r.Result.Stderr)
+			}
+			if options.ByExitCode {
+				group.ExitCode = r.Result.ExitCode
+			}
+		}
+
+		key := fmt.Sprintf("%s\x00%t\x00%d\x00%s", group.Status, group.Failed, group.ExitCode, group.Output)
+		if i, ok := index[key]; ok {
+			groups[i].Hosts = append(groups[i].Hosts, r.Host)
+		} else {
+			index[key] = len(groups)
+			groups = append(groups, group)
+		}
+	}
+	slices.SortStableFunc(groups, func(a, b OutputGroup) int {
+		return len(b.Hosts) - len(a.Hosts)
+	})
+	return groups
+}
+
+// Title returns the folded hosts of the group with their number, its exit code, failure or status.
+func (g OutputGroup) Title() string {
+	title := FoldHosts(g.Hosts)
+	if len(g.Hosts) > 1 {
+		title += fmt.Sprintf(" (%d hosts)", len(g.Hosts))
+	}
+	if g.Status != "" {
+		return title + ": " + g.Status
+	}
+	if g.ExitCode != 0 {
+		return title + fmt.Sprintf(": exit code %d", g.ExitCode)
+	}
+	if g.Failed {
+		return title + ": failed"
+	}
+	return title
+}
+
+// WriteTo writes every group as its title followed by its output, implements io.WriterTo.
+func (gs OutputGroups) WriteTo(w io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+	for _, g := range gs {
+		fmt.Fprintf(&buffer, "%s\n%s\n%s\n", aggregateSeparator, g.Title(), aggregateSeparator)
+		buffer.WriteString(g.Output)
+		if g.Output != "" && !strings.HasSuffix(g.Output, "\n") {
+			buffer.WriteByte('\n')
+		}
+	}
+	return buffer.WriteTo(w)
+}
+
+// String returns the groups as written by WriteTo.
+func (gs OutputGroups) String() string {
+	var builder strings.Builder
+	_, _ = gs.WriteTo(&builder)
+	return builder.String()
+}
+
+// hostPattern is a host split around its last number, e.g. web01.example.com.
+type hostPattern struct {
+	prefix string
+	suffix string
+	// width is the number of digits of zero-padded numbers, zero when not padded.
+	width int
+}
+
+// FoldHosts folds hosts differing by a number into ranges, e.g. web1,web2,web3,web5,db into db,web[1-3,5].
+// Zero-padded numbers keep their width, e.g. node[01-12].
+//
+//goland:noinspection GoUnusedExportedFunction
+func FoldHosts(hosts []string) string {
+	numbers := make(map[hostPattern][]int)
+	var folded []string
+	for _, host := range hosts {
+		pattern, n, ok := splitHostNumber(host)
+		if !ok {
+			folded = append(folded, host)
+			continue
+		}
+		numbers[pattern] = append(numbers[pattern], n)
+	}
+
+	// unpadded numbers as long as padded ones, e.g. node10 and node09, fold together
+	for pattern, ns := range numbers {
+		if pattern.width != 0 {
+			continue
+		}
+		var kept []int
+		for _, n := range ns {
+			padded := hostPattern{prefix: pattern.prefix, suffix: pattern.suffix, width: len(strconv.Itoa(n))}
+			if _, ok := numbers[padded]; ok {
+				numbers[padded] = append(numbers[padded], n)
+			} else {
+				kept = append(kept, n)
+			}
+		}
+		if len(kept) == 0 {
+			delete(numbers, pattern)
+		} else {
+			numbers[pattern] = kept
+		}
+	}
+
+	for pattern, ns := range numbers {
+		folded = append(folded, pattern.fold(ns))
+	}
+	slices.Sort(folded)
+	return strings.Join(slices.Compact(folded), ",")
+}
+
+// splitHostNumber finds the last number of host.
+func splitHostNumber(host string) (hostPattern, int, bool) {
+	end := strings.LastIndexAny(host, "0123456789") + 1
+	if end == 0 {
+		return hostPattern{}, 0, false
+	}
+	start := end - 1
+	for start > 0 && host[start-1] >= '0' && host[start-1] <= '9' {
+		start--
+	}
+	digits := host[start:end]
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return hostPattern{}, 0, false
+	}
+	pattern := hostPattern{prefix: host[:start], suffix: host[end:]}
+	if len(digits) > 1 && digits[0] == '0' {
+		pattern.width = len(digits)
+	}
+	return pattern, n, true
+}
+
+// fold returns the hosts of the numbers, with a range of consecutive numbers between brackets.
+func (p hostPattern) fold(ns []int) string {
+	slices.Sort(ns)
+	ns = slices.Compact(ns)
+	if len(ns) == 1 {
+		return p.prefix + p.format(ns[0]) + p.suffix
+	}
+
+	var ranges []string
+	for i := 0; i < len(ns); {
+		j := i
+		for j+1 < len(ns) && ns[j+1] == ns[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, p.format(ns[i]))
+		} else {
+			ranges = append(ranges, p.format(ns[i])+"-"+p.format(ns[j]))
+		}
+		i = j + 1
+	}
+	return p.prefix + "[" + strings.Join(ranges, ",") + "]" + p.suffix
+}
+
+func (p hostPattern) format(n int) string {
+	return fmt.Sprintf("%0*d", p.width, n)
+}
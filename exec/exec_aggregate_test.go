@@ -0,0 +1,90 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFoldHosts(t *testing.T) {
+	tests := []struct {
+		hosts    []string
+		expected string
+	}{
+		{[]string{"web1"}, "web1"},
+		{[]string{"web3", "web1", "web2", "web5", "db", "web2"}, "db,web[1-3,5]"},
+		{[]string{"node01", "node02", "node09", "node10", "node11"}, "node[01-02,09-11]"},
+		{[]string{"web1.example.com", "web2.example.com", "web1.example.org"}, "web1.example.org,web[1-2].example.com"},
+		{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, "10.0.0.[1-3]"},
+		{[]string{"rack1-node1", "rack1-node2", "rack2-node1"}, "rack1-node[1-2],rack2-node1"},
+	}
+	for _, test := range tests {
+		if actual := FoldHosts(test.hosts); actual != test.expected {
+			t.Fatalf("%v: expected %s, got %s", test.hosts, test.expected, actual)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	result := func(host, stdout string, exitCode int) FleetResult {
+		r := FleetResult{Host: host, Result: &CommandResult{Host: host, Stdout: []byte(stdout), ExitCode: exitCode}}
+		if exitCode != 0 {
+			r.Err = &CommandError{Host: host, ExitCode: exitCode}
+		}
+		return r
+	}
+	results := FleetResults{
+		result("web1", "ok\n", 0),
+		result("web2", "ok\n", 0),
+		result("web3", "ok\n", 1),
+		result("db1", "down", 0),
+		result("web4", "ok\n", 0),
+		{Host: "web7", Result: &CommandResult{Host: "web7", Stdout: []byte("ok\n"), ExitCode: -1}, Err: ErrCanceled},
+		{Host: "web5", Err: errors.New("connection refused")},
+		{Host: "web6", Skipped: true},
+	}
+
+	expected := "----------------\n" +
+		"web[1-2,4] (3 hosts)\n" +
+		"----------------\n" +
+		"ok\n" +
+		"----------------\n" +
+		"web[3,7] (2 hosts): failed\n" +
+		"----------------\n" +
+		"ok\n" +
+		"----------------\n" +
+		"db1\n" +
+		"----------------\n" +
+		"down\n" +
+		"----------------\n" +
+		"web5: connection refused\n" +
+		"----------------\n" +
+		"----------------\n" +
+		"web6: skipped\n" +
+		"----------------\n"
+	if actual := results.Aggregate(AggregateOptions{}).String(); actual != expected {
+		t.Fatalf("not expected: [%s]", actual)
+	}
+
+	groups := results.Aggregate(AggregateOptions{ByExitCode: true})
+	if len(groups) != 6 || groups[0].Title() != "web[1-2,4] (3 hosts)" || groups[1].Title() != "web3: exit code 1" ||
+		groups[3].Title() != "web7: exit code -1" {
+		t.Fatalf("not expected: [%s]", groups)
+	}
+}
+
+func TestFleetAggregate(t *testing.T) {
+	fleet := NewFleet(newFleetTestMachines("a1", "a2", "b!", "a3")...)
+	results, _ := fleet.RunCmd(context.Background(), NewCommandInOut(nil, nil, nil, nil), "", "echo", "hello")
+
+	groups := results.Aggregate(AggregateOptions{ByExitCode: true, Stderr: true})
+	if len(groups) != 2 {
+		t.Fatalf("not expected: [%s]", groups)
+	}
+	if groups[0].Title() != "a[1-3] (3 hosts)" || groups[0].Output != "hello\n" {
+		t.Fatalf("not expected: %+v", groups[0])
+	}
+	if groups[1].Title() != "b: exit code 3" || groups[1].Output != "failed b\n" {
+		t.Fatalf("not expected: %+v", groups[1])
+	}
+}
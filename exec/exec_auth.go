@@ -0,0 +1,288 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// PassphraseFunc returns the passphrase of the encrypted private key file.
+type PassphraseFunc func(path string) ([]byte, error)
+
+// PromptFunc answers a keyboard-interactive question, echo tells whether the answer may be displayed.
+type PromptFunc func(user, instruction, question string, echo bool) (string, error)
+
+// SshAuth is an authentication source of NewSshClientConfig.
+type SshAuth func(chain *sshAuthChain) error
+
+// sshAuthChain collects authentication methods in order. The SSH client tries every method
+// type only once, so the signers of all public key sources are offered by a single method
+// at the position of the first one.
+type sshAuthChain struct {
+	methods []ssh.AuthMethod
+	names   map[string]bool
+	signers []func() ([]ssh.Signer, error)
+
+	// failures are the errors of the public key sources the last time they were used
+	mutex    sync.Mutex
+	failures []error
+}
+
+// sshAuthChains maps the first method of every chain, shared by the ssh.ClientConfig using
+// its methods, to the chain, so that failed connections can report why sources were not used.
+var sshAuthChains sync.Map
+
+func (c *sshAuthChain) add(name string, method ssh.AuthMethod) {
+	if c.names[name] {
+		return
+	}
+	c.names[name] = true
+	c.methods = append(c.methods, method)
+}
+
+func (c *sshAuthChain) addSigners(signers func() ([]ssh.Signer, error)) {
+	c.add("publickey", ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var all []ssh.Signer
+		var errs []error
+		for _, source := range c.signers {
+			s, err := source()
+			if err != nil {
+				// try the remaining sources, e.g. when the agent went away
+				errs = append(errs, err)
+				continue
+			}
+			all = append(all, s...)
+		}
+		c.mutex.Lock()
+		c.failures = errs
+		c.mutex.Unlock()
+		if len(all) == 0 && len(errs) > 0 {
+			return nil, errs[0]
+		}
+		return all, nil
+	}))
+	c.signers = append(c.signers, signers)
+}
+
+// SshAuthMethods returns the authentication methods in the order of the sources.
+// Only the first password and the first keyboard-interactive source are used.
+func SshAuthMethods(auths ...SshAuth) ([]ssh.AuthMethod, error) {
+	chain := &sshAuthChain{names: make(map[string]bool)}
+	for _, auth := range auths {
+		if err := auth(chain); err != nil {
+			return nil, err
+		}
+	}
+	if len(chain.methods) == 0 {
+		return nil, fmt.Errorf("%w: no authentication method available", ErrAuthentication)
+	}
+	sshAuthChains.Store(&chain.methods[0], chain)
+	return chain.methods, nil
+}
+
+// withAuthFailures adds to the authentication error of a connection using config the errors of
+// the sources that could not be used, e.g. a certificate that has expired since config was created.
+func withAuthFailures(err error, config *ssh.ClientConfig) error {
+	if !errors.Is(err, ErrAuthentication) || len(config.Auth) == 0 {
+		return err
+	}
+	value, ok := sshAuthChains.Load(&config.Auth[0])
+	if !ok {
+		return err
+	}
+	chain := value.(*sshAuthChain)
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	for _, failure := range chain.failures {
+		if !errors.Is(err, failure) {
+			err = fmt.Errorf("%w: %w", err, failure)
+		}
+	}
+	return err
+}
+
+// NewSshClientConfig creates the configuration of NewSshMachine with the authentication
+// methods in the order of the sources, e.g. the ssh-agent, then key files, then a password.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewSshClientConfig(user string, hostKeyCallback ssh.HostKeyCallback, auths ...SshAuth) (*ssh.ClientConfig, error) {
+	methods, err := SshAuthMethods(auths...)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// AgentAuth uses the keys of the ssh-agent listening on SSH_AUTH_SOCK.
+// It is skipped when no agent is available, e.g. on CI runners. The agent is connected
+// for every authentication and signature, so it may be restarted while machines are in use.
+//
+//goland:noinspection GoUnusedExportedFunction
+func AgentAuth() SshAuth {
+	return func(chain *sshAuthChain) error {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil
+		}
+		chain.addSigners(func() ([]ssh.Signer, error) {
+			var signers []ssh.Signer
+			err := withAgent(socket, func(client agent.ExtendedAgent) error {
+				keys, err := client.List()
+				if err != nil {
+					return err
+				}
+				for _, key := range keys {
+					signers = append(signers, &agentSigner{socket: socket, key: key})
+				}
+				return nil
+			})
+			return signers, err
+		})
+		return nil
+	}
+}
+
+// withAgent connects to the ssh-agent for the duration of f.
+func withAgent(socket string, f func(client agent.ExtendedAgent) error) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("%w: cannot connect to ssh-agent", err)
+	}
+	defer conn.Close()
+	return f(agent.NewClient(conn))
+}
+
+// agentSigner signs with a key of the ssh-agent, without keeping the agent connected.
+type agentSigner struct {
+	socket string
+	key    *agent.Key
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm implements ssh.AlgorithmSigner, e.g. for rsa-sha2-256 with RSA keys.
+func (s *agentSigner) SignWithAlgorithm(_ io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	var signature *ssh.Signature
+	err := withAgent(s.socket, func(client agent.ExtendedAgent) error {
+		var err error
+		signature, err = client.SignWithFlags(s.key, data, flags)
+		return err
+	})
+	return signature, err
+}
+
+// KeyFileAuth uses the private key file, passphrase is called when the key is encrypted.
+// A missing file is skipped, a key that cannot be parsed or decrypted is an error.
+//
+//goland:noinspection GoUnusedExportedFunction
+func KeyFileAuth(path string, passphrase PassphraseFunc) SshAuth {
+	return func(chain *sshAuthChain) error {
+		signer, err := PrivateKey(path, passphrase)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return SignerAuth(signer)(chain)
+	}
+}
+
+// SignerAuth uses the signers, e.g. keys loaded from a secret store.
+//
+//goland:noinspection GoUnusedExportedFunction
+func SignerAuth(signers ...ssh.Signer) SshAuth {
+	return func(chain *sshAuthChain) error {
+		chain.addSigners(func() ([]ssh.Signer, error) {
+			return signers, nil
+		})
+		return nil
+	}
+}
+
+// PasswordAuth uses the password.
+//
+//goland:noinspection GoUnusedExportedFunction
+func PasswordAuth(password string) SshAuth {
+	return func(chain *sshAuthChain) error {
+		chain.add("password", ssh.Password(password))
+		return nil
+	}
+}
+
+// PasswordPromptAuth asks for the password when the server requests it.
+//
+//goland:noinspection GoUnusedExportedFunction
+func PasswordPromptAuth(prompt func() (string, error)) SshAuth {
+	return func(chain *sshAuthChain) error {
+		chain.add("password", ssh.PasswordCallback(prompt))
+		return nil
+	}
+}
+
+// KeyboardInteractiveAuth answers the questions of the server with prompt.
+//
+//goland:noinspection GoUnusedExportedFunction
+func KeyboardInteractiveAuth(prompt PromptFunc) SshAuth {
+	return func(chain *sshAuthChain) error {
+		chain.add("keyboard-interactive", ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i, question := range questions {
+				answer, err := prompt(user, instruction, question, echos[i])
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = answer
+			}
+			return answers, nil
+		}))
+		return nil
+	}
+}
+
+// PrivateKey reads a private key file, passphrase is called when the key is encrypted.
+func PrivateKey(path string, passphrase PassphraseFunc) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) && passphrase != nil {
+		secret, err := passphrase(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: no passphrase for %s", err, path)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, secret)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot decrypt %s", err, path)
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot parse %s", err, path)
+	}
+	return signer, nil
+}
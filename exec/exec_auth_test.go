@@ -0,0 +1,223 @@
+package exec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent serves an ssh-agent holding key and points SSH_AUTH_SOCK to it.
+func startTestAgent(t *testing.T, key ed25519.PrivateKey) net.Listener {
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener := serveTestAgent(t, keyring, socket)
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	return listener
+}
+
+// serveTestAgent serves the keyring on the unix socket until the test ends.
+func serveTestAgent(t *testing.T, keyring agent.Agent, socket string) net.Listener {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestSshAuth(t *testing.T) {
+	server := newTestSshServer(t)
+
+	run := func(t *testing.T, auths ...SshAuth) error {
+		config, err := NewSshClientConfig("test", ssh.InsecureIgnoreHostKey(), auths...)
+		if err != nil {
+			return err
+		}
+		machine := NewSshMachine("127.0.0.1", server.port(), config)
+		defer machine.Close()
+		_, err = machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+		return err
+	}
+
+	t.Run("Agent", func(t *testing.T) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		startTestAgent(t, key)
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.authorize(signer.PublicKey())
+
+		if err := run(t, AgentAuth()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Agent restarted", func(t *testing.T) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := startTestAgent(t, key)
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.authorize(signer.PublicKey())
+
+		config, err := NewSshClientConfig("test", ssh.InsecureIgnoreHostKey(), AgentAuth())
+		if err != nil {
+			t.Fatal(err)
+		}
+		connect := func() error {
+			machine := NewSshMachine("127.0.0.1", server.port(), config)
+			defer machine.Close()
+			_, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+			return err
+		}
+		if err := connect(); err != nil {
+			t.Fatal(err)
+		}
+
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		_ = listener.Close()
+		_ = os.Remove(socket)
+		if err := connect(); err == nil {
+			t.Fatal("expected error without agent")
+		}
+
+		keyring := agent.NewKeyring()
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+		serveTestAgent(t, keyring, socket)
+		if err := connect(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("No agent", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		if err := run(t, AgentAuth()); !errors.Is(err, ErrAuthentication) {
+			t.Fatalf("expected authentication error, got %v", err)
+		}
+		if err := run(t, AgentAuth(), PasswordAuth("test")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Encrypted key", func(t *testing.T) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "id_ed25519")
+		writeTestFile(t, path, string(pem.EncodeToMemory(block)))
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.authorize(signer.PublicKey())
+
+		var asked string
+		passphrase := func(path string) ([]byte, error) {
+			asked = path
+			return []byte("secret"), nil
+		}
+		if err := run(t, KeyFileAuth(path, passphrase)); err != nil {
+			t.Fatal(err)
+		}
+		if asked != path {
+			t.Fatalf("passphrase not asked for %s", path)
+		}
+
+		wrong := func(string) ([]byte, error) {
+			return []byte("wrong"), nil
+		}
+		if err := run(t, KeyFileAuth(path, wrong)); err == nil {
+			t.Fatal("expected decryption error")
+		}
+		var missingErr *ssh.PassphraseMissingError
+		if err := run(t, KeyFileAuth(path, nil)); !errors.As(err, &missingErr) {
+			t.Fatalf("expected missing passphrase, got %v", err)
+		}
+	})
+
+	t.Run("Missing key file", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		missing := filepath.Join(t.TempDir(), "id_ed25519")
+		if err := run(t, AgentAuth(), KeyFileAuth(missing, nil), PasswordAuth("test")); err != nil {
+			t.Fatal(err)
+		}
+		if err := run(t, KeyFileAuth(missing, nil)); !errors.Is(err, ErrAuthentication) {
+			t.Fatalf("expected authentication error, got %v", err)
+		}
+
+		corrupt := filepath.Join(t.TempDir(), "id_rsa")
+		writeTestFile(t, corrupt, "not a key")
+		if err := run(t, KeyFileAuth(corrupt, nil), PasswordAuth("test")); err == nil {
+			t.Fatal("expected parse error")
+		}
+	})
+
+	t.Run("Fallback to keyboard-interactive", func(t *testing.T) {
+		var questions []string
+		prompt := func(user, instruction, question string, echo bool) (string, error) {
+			questions = append(questions, question)
+			return "test", nil
+		}
+		if err := run(t, SignerAuth(newTestSigner(t)), KeyboardInteractiveAuth(prompt), PasswordAuth("wrong")); err != nil {
+			t.Fatal(err)
+		}
+		if len(questions) != 1 || questions[0] != "Password: " {
+			t.Fatalf("not expected questions: %v", questions)
+		}
+	})
+
+	t.Run("Password prompt", func(t *testing.T) {
+		prompt := func() (string, error) {
+			return "test", nil
+		}
+		if err := run(t, PasswordPromptAuth(prompt)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("No method", func(t *testing.T) {
+		if _, err := SshAuthMethods(); !errors.Is(err, ErrAuthentication) {
+			t.Fatalf("expected authentication error, got %v", err)
+		}
+	})
+}
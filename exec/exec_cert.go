@@ -0,0 +1,128 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrCertificateExpired is returned when a user certificate is no longer valid.
+	ErrCertificateExpired = errors.New("certificate expired")
+	// ErrCertificateNotYetValid is returned when a user certificate is not valid yet.
+	ErrCertificateNotYetValid = errors.New("certificate not yet valid")
+	// ErrCertificatePrincipal is returned when the user is not a principal of the certificate.
+	ErrCertificatePrincipal = errors.New("certificate principal not allowed")
+	// ErrCertificateInvalid is returned when the file is not an OpenSSH user certificate for the key.
+	ErrCertificateInvalid = errors.New("invalid certificate")
+)
+
+// CertificateError describes a user certificate that cannot be used.
+// It matches one of the ErrCertificate errors with errors.Is.
+type CertificateError struct {
+	KeyId       string
+	Serial      uint64
+	ValidAfter  time.Time
+	ValidBefore time.Time
+	Err         error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("%v: %s (serial %d) is valid from %s until %s", e.Err, e.KeyId, e.Serial,
+		e.ValidAfter.Format(time.RFC3339), e.ValidBefore.Format(time.RFC3339))
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateCertificate checks that cert is a user certificate valid at the given time
+// and, unless principal is empty, issued for principal.
+func ValidateCertificate(cert *ssh.Certificate, principal string, now time.Time) error {
+	certErr := &CertificateError{
+		KeyId:       cert.KeyId,
+		Serial:      cert.Serial,
+		ValidAfter:  certificateTime(cert.ValidAfter),
+		ValidBefore: certificateTime(cert.ValidBefore),
+	}
+	unix := uint64(now.Unix())
+	switch {
+	case cert.CertType != ssh.UserCert:
+		certErr.Err = fmt.Errorf("%w: not a user certificate", ErrCertificateInvalid)
+	case unix < cert.ValidAfter:
+		certErr.Err = ErrCertificateNotYetValid
+	case cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore:
+		certErr.Err = ErrCertificateExpired
+	case principal != "" && len(cert.ValidPrincipals) > 0 && !slices.Contains(cert.ValidPrincipals, principal):
+		certErr.Err = fmt.Errorf("%w: %s", ErrCertificatePrincipal, principal)
+	default:
+		return nil
+	}
+	return certErr
+}
+
+func certificateTime(t uint64) time.Time {
+	if t >= 1<<63 {
+		return time.Unix(1<<63-1, 0)
+	}
+	return time.Unix(int64(t), 0)
+}
+
+// CertificateSigner reads a private key with its OpenSSH certificate, certPath defaults to the
+// key path followed by "-cert.pub". Passphrase is called when the key is encrypted.
+func CertificateSigner(keyPath, certPath string, passphrase PassphraseFunc) (ssh.Signer, *ssh.Certificate, error) {
+	if certPath == "" {
+		certPath = keyPath + "-cert.pub"
+	}
+	signer, err := PrivateKey(keyPath, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: cannot parse %s: %w", ErrCertificateInvalid, certPath, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s is not a certificate", ErrCertificateInvalid, certPath)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s does not match %s: %w", ErrCertificateInvalid, certPath, keyPath, err)
+	}
+	return certSigner, cert, nil
+}
+
+// CertificateAuth uses the private key with its certificate, see CertificateSigner. The certificate
+// is validated for principal when the chain is built and again whenever the client authenticates,
+// an expired certificate fails the connection with a CertificateError, also when other sources of
+// the chain were tried.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CertificateAuth(keyPath, certPath, principal string, passphrase PassphraseFunc) SshAuth {
+	return func(chain *sshAuthChain) error {
+		signer, cert, err := CertificateSigner(keyPath, certPath, passphrase)
+		if err != nil {
+			return err
+		}
+		if err := ValidateCertificate(cert, principal, time.Now()); err != nil {
+			return err
+		}
+		chain.addSigners(func() ([]ssh.Signer, error) {
+			if err := ValidateCertificate(cert, principal, time.Now()); err != nil {
+				return nil, err
+			}
+			return []ssh.Signer{signer}, nil
+		})
+		return nil
+	}
+}
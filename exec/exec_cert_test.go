@@ -0,0 +1,123 @@
+package exec
+
+import (
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestCertificate writes a new key and its user certificate signed by ca.
+func writeTestCertificate(t *testing.T, ca ssh.Signer, keyPath string, principals []string, validAfter, validBefore time.Time) {
+	t.Helper()
+	publicKey := writeTestKey(t, keyPath)
+	cert := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		KeyId:           "deploy",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, keyPath+"-cert.pub", string(ssh.MarshalAuthorizedKey(cert)))
+}
+
+func TestCertificateAuth(t *testing.T) {
+	server := newTestSshServer(t)
+	ca := newTestSigner(t)
+	server.trustUserAuthority(ca.PublicKey())
+	dir := t.TempDir()
+	now := time.Now()
+
+	run := func(auth SshAuth) error {
+		config, err := NewSshClientConfig("test", ssh.InsecureIgnoreHostKey(), auth)
+		if err != nil {
+			return err
+		}
+		machine := NewSshMachine("127.0.0.1", server.port(), config)
+		defer machine.Close()
+		_, err = machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+		return err
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "valid")
+		writeTestCertificate(t, ca, keyPath, []string{"test"}, now.Add(-time.Minute), now.Add(time.Hour))
+		if err := run(CertificateAuth(keyPath, "", "test", nil)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "expired")
+		writeTestCertificate(t, ca, keyPath, []string{"test"}, now.Add(-time.Hour), now.Add(-time.Minute))
+		err := run(CertificateAuth(keyPath, "", "test", nil))
+		var certErr *CertificateError
+		if !errors.Is(err, ErrCertificateExpired) || !errors.As(err, &certErr) {
+			t.Fatalf("expected expired certificate, got %v", err)
+		}
+		if certErr.KeyId != "deploy" || certErr.Serial != 42 {
+			t.Fatalf("not expected: %v", certErr)
+		}
+	})
+
+	t.Run("Expires before dialing", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "short")
+		writeTestCertificate(t, ca, keyPath, []string{"test"}, now.Add(-time.Minute), now.Add(time.Second))
+		methods, err := SshAuthMethods(CertificateAuth(keyPath, "", "test", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Until(now.Add(2 * time.Second).Truncate(time.Second)))
+		config := &ssh.ClientConfig{User: "test", Auth: methods, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+		machine := NewSshMachine("127.0.0.1", server.port(), config)
+		defer machine.Close()
+		if _, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true"); !errors.Is(err, ErrCertificateExpired) {
+			t.Fatalf("expected expired certificate, got %v", err)
+		}
+	})
+
+	t.Run("Expires before dialing with other sources", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "short with others")
+		start := time.Now()
+		writeTestCertificate(t, ca, keyPath, []string{"test"}, start.Add(-time.Minute), start.Add(time.Second))
+		// the other key is not authorized
+		methods, err := SshAuthMethods(SignerAuth(newTestSigner(t)), CertificateAuth(keyPath, "", "test", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Until(start.Add(2 * time.Second).Truncate(time.Second)))
+		config := &ssh.ClientConfig{User: "test", Auth: methods, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+		machine := NewSshMachine("127.0.0.1", server.port(), config)
+		defer machine.Close()
+		_, err = machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+		var certErr *CertificateError
+		if !errors.Is(err, ErrAuthentication) || !errors.As(err, &certErr) || !errors.Is(err, ErrCertificateExpired) {
+			t.Fatalf("expected expired certificate, got %v", err)
+		}
+	})
+
+	t.Run("Principal", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "principal")
+		writeTestCertificate(t, ca, keyPath, []string{"admin"}, now.Add(-time.Minute), now.Add(time.Hour))
+		if err := run(CertificateAuth(keyPath, "", "test", nil)); !errors.Is(err, ErrCertificatePrincipal) {
+			t.Fatalf("expected principal error, got %v", err)
+		}
+	})
+
+	t.Run("Certificate of another key", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "valid")
+		otherPath := filepath.Join(dir, "other")
+		writeTestKey(t, otherPath)
+		if err := run(CertificateAuth(otherPath, keyPath+"-cert.pub", "test", nil)); !errors.Is(err, ErrCertificateInvalid) {
+			t.Fatalf("expected invalid certificate, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package exec
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+// CommandResult describes a command that has been run on a machine.
+type CommandResult struct {
+	// Host is the machine the command ran on.
+	Host string
+	// CommandLine is the exact command line that was executed.
+	CommandLine string
+	Stdout      []byte
+	Stderr      []byte
+	// ExitCode is the exit status of the command, -1 when it did not exit normally.
+	ExitCode int
+	// Signal is the name of the signal that terminated the command, empty when there is none.
+	Signal    string
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// Duration returns how long the command ran.
+func (r *CommandResult) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// Success reports whether the command exited with status 0.
+func (r *CommandResult) Success() bool {
+	return r.ExitCode == 0 && r.Signal == ""
+}
+
+// commandSpec is a single command invocation handled by the machine implementations.
+type commandSpec struct {
+	dir     string
+	command string
+	args    []string
+	env     Env
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func newCommandSpec(dir, command string, arg ...string) *commandSpec {
+	return &commandSpec{
+		dir:     dir,
+		command: command,
+		args:    arg,
+	}
+}
+
+// resultCapture collects stdout and stderr of a command, additionally
+// copying them to the writers of io when those are set.
+type resultCapture struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (c *resultCapture) attach(spec *commandSpec, io CommandInOut) {
+	out, err := serializeWriters(io.Out(), io.Err())
+	spec.stdout = teeWriter(&c.stdout, out)
+	spec.stderr = teeWriter(&c.stderr, err)
+}
+
+func (c *resultCapture) fill(result *CommandResult) {
+	if result == nil {
+		return
+	}
+	result.Stdout = c.stdout.Bytes()
+	result.Stderr = c.stderr.Bytes()
+}
+
+func teeWriter(buffer *bytes.Buffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buffer
+	}
+	return io.MultiWriter(buffer, w)
+}
+
+// buildCommandLine joins the command and its arguments into a POSIX shell command line,
+// quoting every word so that the shell passes it to the command unchanged.
+func buildCommandLine(command string, arg ...string) string {
+	words := make([]string, 0, len(arg)+1)
+	words = append(words, shellQuote(command))
+	for _, a := range arg {
+		words = append(words, shellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote quotes s for a POSIX shell. Words consisting only of characters
+// without special meaning are returned as they are.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, isUnsafeShellRune) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func isUnsafeShellRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("@%+=:,./_-", r)
+}
@@ -0,0 +1,57 @@
+package exec
+
+import (
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"", "''"},
+		{"ls", "ls"},
+		{"/usr/bin/env", "/usr/bin/env"},
+		{"--exclude=.git", "--exclude=.git"},
+		{"user@host:/dir", "user@host:/dir"},
+		{"a b", "'a b'"},
+		{"$HOME", "'$HOME'"},
+		{"a;rm -rf /", "'a;rm -rf /'"},
+		{"it's", `'it'\''s'`},
+		{"*.go", "'*.go'"},
+		{"~/dir", "'~/dir'"},
+	}
+	for _, test := range tests {
+		if actual := shellQuote(test.in); actual != test.expected {
+			t.Errorf("shellQuote(%q): expected [%s], got [%s]", test.in, test.expected, actual)
+		}
+	}
+}
+
+func TestRemoteCommandLine(t *testing.T) {
+	t.Run("Quoted", func(t *testing.T) {
+		spec := newCommandSpec("/dir with space", "echo", "a b", "$HOME")
+		expected := "cd '/dir with space' && echo 'a b' '$HOME'"
+		if actual := remoteCommandLine(spec, Env{}); actual != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+		}
+	})
+
+	t.Run("Exported variables", func(t *testing.T) {
+		spec := newCommandSpec("/tmp", "printenv", "B")
+		exported := Env{Vars: map[string]string{"B": "x y", "A": "1"}}
+		expected := "export A=1 'B=x y' && cd /tmp && printenv B"
+		if actual := remoteCommandLine(spec, exported); actual != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+		}
+	})
+
+	t.Run("Clean environment", func(t *testing.T) {
+		spec := newCommandSpec("", "printenv")
+		spec.env = Env{Vars: map[string]string{"A": "1"}, Clean: true}
+		expected := "env -i A=1 printenv"
+		if actual := remoteCommandLine(spec, Env{}); actual != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+		}
+	})
+}
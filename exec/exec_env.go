@@ -0,0 +1,87 @@
+package exec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Env describes environment variables passed to the commands of a machine, see Machine.WithEnv.
+type Env struct {
+	Vars map[string]string
+	// Clean starts commands with Vars only instead of the inherited environment.
+	Clean bool
+}
+
+// merge returns the variables of e overridden by the ones of other.
+func (e Env) merge(other Env) Env {
+	merged := Env{
+		Vars:  make(map[string]string, len(e.Vars)+len(other.Vars)),
+		Clean: e.Clean || other.Clean,
+	}
+	for name, value := range e.Vars {
+		merged.Vars[name] = value
+	}
+	for name, value := range other.Vars {
+		merged.Vars[name] = value
+	}
+	return merged
+}
+
+func (e Env) isEmpty() bool {
+	return len(e.Vars) == 0 && !e.Clean
+}
+
+func (e Env) names() []string {
+	names := make([]string, 0, len(e.Vars))
+	for name := range e.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// assignments returns NAME=value pairs sorted by name.
+func (e Env) assignments() []string {
+	names := e.names()
+	assignments := make([]string, 0, len(names))
+	for _, name := range names {
+		assignments = append(assignments, name+"="+e.Vars[name])
+	}
+	return assignments
+}
+
+// environ returns the environment of a local command, inherited is used unless e is clean.
+func (e Env) environ(inherited []string) []string {
+	if e.Clean {
+		return e.assignments()
+	}
+	return append(append([]string{}, inherited...), e.assignments()...)
+}
+
+func (e Env) validate() error {
+	for name := range e.Vars {
+		if !isEnvName(name) {
+			return fmt.Errorf("invalid environment variable name: [%s]", name)
+		}
+	}
+	return nil
+}
+
+// isEnvName reports whether name is a valid POSIX shell variable name.
+func isEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) < 0
+}
+
+func quoteAll(words []string) []string {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, shellQuote(word))
+	}
+	return quoted
+}
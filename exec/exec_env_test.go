@@ -0,0 +1,76 @@
+package exec
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	server := newTestSshServer(t)
+	machines := map[string]Machine{
+		"local":  NewLocalMachine("test"),
+		"remote": server.machine(),
+	}
+
+	for name, machine := range machines {
+		io := NewCommandInOut(nil, nil, nil, nil)
+
+		t.Run(name+" inherited", func(t *testing.T) {
+			m := machine.WithEnv(Env{Vars: map[string]string{"FOO": "bar baz", "QUX": "$HOME"}})
+			output, err := m.ExecuteCmd(io, "", "sh", "-c", `echo "$FOO|$QUX"`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != "bar baz|$HOME\n" {
+				t.Fatalf("not expected: [%s]", output)
+			}
+		})
+
+		t.Run(name+" clean", func(t *testing.T) {
+			m := machine.WithEnv(Env{Vars: map[string]string{"FOO": "bar"}, Clean: true})
+			output, err := m.ExecuteCmd(io, "", "/usr/bin/env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != "FOO=bar\n" {
+				t.Fatalf("not expected: [%s]", output)
+			}
+		})
+
+		t.Run(name+" invalid name", func(t *testing.T) {
+			m := machine.WithEnv(Env{Vars: map[string]string{"A=B": "x"}})
+			if err := m.RunCmd(io, "", "true"); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+
+	t.Run("remote rejected by server", func(t *testing.T) {
+		server.rejectEnv.Store(true)
+		defer server.rejectEnv.Store(false)
+
+		m := machines["remote"].WithEnv(Env{Vars: map[string]string{"FOO": "it's"}})
+		result, err := m.RunCmdWithResult(context.Background(), NewCommandInOut(nil, nil, nil, nil), "/tmp", "printenv", "FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result.Stdout) != "it's\n" {
+			t.Fatalf("not expected: [%s]", result.Stdout)
+		}
+		if !strings.HasPrefix(result.CommandLine, "export ") {
+			t.Fatalf("expected exported variables: [%s]", result.CommandLine)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		m := machines["local"].WithEnv(Env{Vars: map[string]string{"A": "1", "B": "1"}}).WithEnv(Env{Vars: map[string]string{"B": "2"}})
+		output, err := m.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "sh", "-c", `echo "$A$B"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "12\n" {
+			t.Fatalf("not expected: [%s]", output)
+		}
+	})
+}
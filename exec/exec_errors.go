@@ -0,0 +1,149 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrTimeout is returned when a command is killed because its context deadline expired.
+	ErrTimeout = errors.New("command timed out")
+	// ErrCanceled is returned when a command is killed because its context was canceled.
+	ErrCanceled = errors.New("command canceled")
+	// ErrConnection is returned when the connection to a machine cannot be established or is lost.
+	ErrConnection = errors.New("connection failed")
+	// ErrAuthentication is returned when the SSH server rejects all authentication methods.
+	ErrAuthentication = errors.New("authentication failed")
+	// ErrCommandNotFound is returned when the command does not exist on the machine.
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrCommandFailed is returned when the command exits with a non-zero status or is killed by a signal.
+	ErrCommandFailed = errors.New("command failed")
+)
+
+// exitCodeNotFound is the exit status of POSIX shells for commands that cannot be found.
+const exitCodeNotFound = 127
+
+// stderrTailSize is how many trailing bytes of stderr are kept in a CommandError.
+const stderrTailSize = 1024
+
+// CommandError is returned by every Machine when a command fails. It matches the sentinel
+// errors of this package with errors.Is and unwraps to the underlying error.
+type CommandError struct {
+	// Host is the machine the command ran on.
+	Host string
+	// Command is the command line that failed.
+	Command string
+	// ExitCode is the exit status of the command, -1 when it did not exit normally.
+	ExitCode int
+	// Signal is the name of the signal that terminated the command, empty when there is none.
+	Signal string
+	// Stderr is the tail of the standard error output.
+	Stderr string
+	Err    error
+
+	notFound bool
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("[%s] %s: %v", e.Host, e.Command, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg = fmt.Sprintf("%s: %s", msg, stderr)
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CommandError) Is(target error) bool {
+	switch target {
+	case ErrCommandNotFound:
+		return e.notFound || e.ExitCode == exitCodeNotFound
+	case ErrCommandFailed:
+		return e.ExitCode > 0 || e.Signal != ""
+	}
+	return false
+}
+
+func newCommandError(result *CommandResult, host, command string, stderr *tailWriter, err error) *CommandError {
+	cmdErr := &CommandError{
+		Host:     host,
+		Command:  command,
+		ExitCode: -1,
+		Err:      err,
+		notFound: errors.Is(err, exec.ErrNotFound),
+	}
+	if result != nil {
+		cmdErr.ExitCode = result.ExitCode
+		cmdErr.Signal = result.Signal
+	}
+	if stderr != nil {
+		cmdErr.Stderr = stderr.String()
+	}
+	return cmdErr
+}
+
+// localCommandError is newCommandError for a local command, which is also not found when its path
+// does not exist. The command cannot be started either when its working directory does not exist,
+// with the same error when it is started in its own process group, that is a plain failure.
+func localCommandError(result *CommandResult, cmd *exec.Cmd, commandLine string, stderr *tailWriter, err error) *CommandError {
+	cmdErr := newCommandError(result, "localhost", commandLine, stderr, err)
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && pathErr.Path == cmd.Path && errors.Is(pathErr.Err, fs.ErrNotExist) {
+		_, dirErr := os.Stat(cmd.Dir)
+		cmdErr.notFound = cmd.Dir == "" || dirErr == nil
+	}
+	return cmdErr
+}
+
+// connectionError classifies an error of establishing an SSH connection.
+func connectionError(err error) error {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		return err
+	}
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return fmt.Errorf("%w: %w", ErrAuthentication, err)
+	}
+	return fmt.Errorf("%w: %w", ErrConnection, err)
+}
+
+// contextError returns nil while ctx is still active, otherwise an error wrapping
+// both ErrTimeout/ErrCanceled and the original context error.
+func contextError(ctx context.Context) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrCanceled, err)
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.max {
+		w.buf = w.buf[len(w.buf)-w.max:]
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	return string(w.buf)
+}
@@ -0,0 +1,115 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCommandErrors(t *testing.T) {
+	server := newTestSshServer(t)
+	machines := map[string]Machine{
+		"local":  NewLocalMachine("test"),
+		"remote": server.machine(),
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, machine := range machines {
+		io := NewCommandInOut(nil, nil, nil, nil)
+
+		t.Run(name+" FileExists", func(t *testing.T) {
+			exists, err := FileExists(machine, io, file)
+			if err != nil || !exists {
+				t.Fatalf("expected file to exist: %v %v", exists, err)
+			}
+			exists, err = FileExists(machine, io, filepath.Join(dir, "missing"))
+			if err != nil || exists {
+				t.Fatalf("expected file to be missing: %v %v", exists, err)
+			}
+			exists, err = DirectoryExists(machine, io, dir)
+			if err != nil || !exists {
+				t.Fatalf("expected directory to exist: %v %v", exists, err)
+			}
+		})
+
+		t.Run(name+" exit code", func(t *testing.T) {
+			err := RunShell(machine, io, "", "echo failure >&2; exit 4")
+			var cmdErr *CommandError
+			if !errors.As(err, &cmdErr) {
+				t.Fatalf("expected CommandError, got: %v", err)
+			}
+			if cmdErr.ExitCode != 4 || cmdErr.Stderr != "failure\n" {
+				t.Fatalf("not expected: %d [%s]", cmdErr.ExitCode, cmdErr.Stderr)
+			}
+			if !errors.Is(err, ErrCommandFailed) || errors.Is(err, ErrCommandNotFound) {
+				t.Fatalf("not expected category: %v", err)
+			}
+		})
+
+		t.Run(name+" command not found", func(t *testing.T) {
+			err := machine.RunCmd(io, "", "no-such-command-1234")
+			if !errors.Is(err, ErrCommandNotFound) {
+				t.Fatalf("expected ErrCommandNotFound, got: %v", err)
+			}
+			err = machine.RunCmdContext(context.Background(), io, "", filepath.Join(dir, "no-such-command"))
+			if !errors.Is(err, ErrCommandNotFound) {
+				t.Fatalf("expected ErrCommandNotFound, got: %v", err)
+			}
+		})
+
+		t.Run(name+" working directory not found", func(t *testing.T) {
+			err := machine.RunCmd(io, filepath.Join(dir, "missing"), "true")
+			if err == nil || errors.Is(err, ErrCommandNotFound) {
+				t.Fatalf("not expected: %v", err)
+			}
+			err = machine.RunCmdContext(context.Background(), io, filepath.Join(dir, "missing"), "true")
+			if err == nil || errors.Is(err, ErrCommandNotFound) {
+				t.Fatalf("not expected: %v", err)
+			}
+		})
+	}
+
+	t.Run("remote exit error unwraps", func(t *testing.T) {
+		err := machines["remote"].RunCmd(NewCommandInOut(nil, nil, nil, nil), "", "false")
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+			t.Fatalf("expected ssh.ExitError, got: %v", err)
+		}
+	})
+
+	t.Run("authentication failure", func(t *testing.T) {
+		config := server.clientConfig()
+		config.Auth = []ssh.AuthMethod{ssh.Password("wrong")}
+		machine := NewSshMachine("127.0.0.1", server.port(), config)
+
+		err := machine.RunCmdContext(context.Background(), NewCommandInOut(nil, nil, nil, nil), "", "true")
+		if !errors.Is(err, ErrAuthentication) {
+			t.Fatalf("expected ErrAuthentication, got: %v", err)
+		}
+	})
+
+	t.Run("connection failure", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		_ = listener.Close()
+
+		machine := NewSshMachine("127.0.0.1", port, server.clientConfig())
+		err = machine.RunCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+		if !errors.Is(err, ErrConnection) {
+			t.Fatalf("expected ErrConnection, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdio "io"
+	"sync"
+	"time"
+)
+
+// Fleet runs the same command on many machines in parallel.
+type Fleet struct {
+	Machines []Machine
+	// Concurrency is the maximum number of machines running the command at once, zero is unlimited.
+	Concurrency int
+	// FailFast cancels the running commands and skips the remaining machines after the first failure.
+	FailFast bool
+}
+
+// NewFleet creates a fleet running commands on all machines at once.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewFleet(machines ...Machine) *Fleet {
+	return &Fleet{Machines: machines}
+}
+
+// FleetResult is the outcome of the command on one machine.
+type FleetResult struct {
+	Machine Machine
+	Host    string
+	// Result is nil when the command could not be started or was skipped.
+	Result *CommandResult
+	Err    error
+	// Skipped is set for machines not started because of FailFast, or because ctx was done,
+	// in which case Err is the error of ctx.
+	Skipped bool
+}
+
+// Success reports whether the command has run and exited with status zero.
+func (r FleetResult) Success() bool {
+	return !r.Skipped && r.Err == nil
+}
+
+// ExitCode returns the exit status of the command, -1 when it has not exited normally.
+func (r FleetResult) ExitCode() int {
+	if r.Result == nil {
+		return -1
+	}
+	return r.Result.ExitCode
+}
+
+// Duration returns how long the command has run.
+func (r FleetResult) Duration() time.Duration {
+	if r.Result == nil {
+		return 0
+	}
+	return r.Result.Duration()
+}
+
+// FleetResults are the results of a fleet command in the order of the machines.
+type FleetResults []FleetResult
+
+// Failed returns the results of the machines where the command has failed.
+func (rs FleetResults) Failed() FleetResults {
+	var failed FleetResults
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Err joins the errors of all machines, nil when the command has succeeded everywhere.
+func (rs FleetResults) Err() error {
+	var errs []error
+	for _, r := range rs {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunCmd runs the command on every machine and returns the results in the order of the machines,
+// the error joins the errors of all failed machines. The output of every machine is collected in
+// its result and also copied to io.Out() and io.Err() as it arrives, each machine gets its own
+// HostInOut when io is a PrefixedInOut. io.In() is not used.
+func (f *Fleet) RunCmd(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (FleetResults, error) {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sharedIo := newSharedInOut(io)
+	results := make(FleetResults, len(f.Machines))
+	if prefixed, ok := io.(*PrefixedInOut); ok {
+		prefixed.Register(hosts(f.Machines)...)
+	}
+
+	concurrency := f.Concurrency
+	if concurrency <= 0 || concurrency > len(f.Machines) {
+		concurrency = len(f.Machines)
+	}
+	slots := make(chan struct{}, max(concurrency, 1))
+
+	var wg sync.WaitGroup
+	for i, machine := range f.Machines {
+		results[i] = FleetResult{Machine: machine, Host: machine.Host()}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// canceled by FailFast after a failure, or by the caller
+			results[i].Skipped = true
+			results[i].Err = contextError(parent)
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *FleetResult) {
+			defer wg.Done()
+			defer func() {
+				<-slots
+			}()
+			if prefixed, ok := io.(*PrefixedInOut); ok {
+				hostIo := prefixed.ForHost(r.Host)
+				defer func() {
+					_ = hostIo.Flush()
+				}()
+				r.Result, r.Err = r.Machine.RunCmdWithResult(ctx, hostIo, dir, command, arg...)
+			} else {
+				r.Result, r.Err = r.Machine.RunCmdWithResult(ctx, sharedIo, dir, command, arg...)
+			}
+			if r.Err != nil && f.FailFast {
+				cancel()
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, results.Err()
+}
+
+// String returns the hosts of the fleet.
+func (f *Fleet) String() string {
+	hosts := make([]string, len(f.Machines))
+	for i, machine := range f.Machines {
+		hosts[i] = machine.Host()
+	}
+	return fmt.Sprint(hosts)
+}
+
+// newSharedInOut returns writers safe to be used by concurrent commands, all writes
+// are serialized in case the writers of io are the same.
+func newSharedInOut(io CommandInOut) CommandInOut {
+	var mutex sync.Mutex
+	shared := func(w stdio.Writer) stdio.Writer {
+		if w == nil {
+			return nil
+		}
+		return &sharedWriter{w: w, mu: &mutex}
+	}
+	return NewCommandInOut(shared(io.Out()), shared(io.Err()), shared(io.Log()), nil)
+}
+
+// sharedWriter serializes writes with the writers sharing its mutex.
+type sharedWriter struct {
+	w  stdio.Writer
+	mu *sync.Mutex
+}
+
+func (w *sharedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
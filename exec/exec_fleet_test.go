@@ -0,0 +1,159 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fleetTestMachine is a local machine with another host name, failing instead of running the command if fail is set.
+type fleetTestMachine struct {
+	Machine
+	host string
+	fail bool
+}
+
+func (m *fleetTestMachine) Host() string {
+	return m.host
+}
+
+func (m *fleetTestMachine) RunCmdWithResult(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (*CommandResult, error) {
+	if m.fail {
+		return m.Machine.RunCmdWithResult(ctx, io, dir, "sh", "-c", "echo failed "+m.host+" >&2; exit 3")
+	}
+	return m.Machine.RunCmdWithResult(ctx, io, dir, command, arg...)
+}
+
+func newFleetTestMachines(hosts ...string) []Machine {
+	machines := make([]Machine, len(hosts))
+	for i, host := range hosts {
+		machines[i] = &fleetTestMachine{
+			Machine: NewLocalMachine(""),
+			host:    strings.TrimSuffix(host, "!"),
+			fail:    strings.HasSuffix(host, "!"),
+		}
+	}
+	return machines
+}
+
+func TestFleet(t *testing.T) {
+	t.Run("Results", func(t *testing.T) {
+		out := &singleWriter{}
+		fleet := NewFleet(newFleetTestMachines("a", "b!", "c")...)
+
+		results, err := fleet.RunCmd(context.Background(), NewCommandInOut(out, out, nil, nil), "", "echo", "hello")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 3 {
+			t.Fatalf("expected exit code 3, got: %v", err)
+		}
+		if len(results) != 3 {
+			t.Fatalf("not expected: %v", results)
+		}
+		for i, host := range []string{"a", "b", "c"} {
+			if results[i].Host != host {
+				t.Fatalf("expected %s, got %s", host, results[i].Host)
+			}
+		}
+		if !results[0].Success() || string(results[0].Result.Stdout) != "hello\n" || results[0].ExitCode() != 0 {
+			t.Fatalf("not expected: %+v", results[0])
+		}
+		if results[1].Success() || results[1].ExitCode() != 3 || string(results[1].Result.Stderr) != "failed b\n" {
+			t.Fatalf("not expected: %+v", results[1])
+		}
+		if !results[2].Success() || results[2].Skipped {
+			t.Fatalf("continue on error expected: %+v", results[2])
+		}
+		if failed := results.Failed(); len(failed) != 1 || failed[0].Host != "b" {
+			t.Fatalf("not expected: %v", failed)
+		}
+		if actual := out.String(); strings.Count(actual, "hello\n") != 2 || !strings.Contains(actual, "failed b\n") {
+			t.Fatalf("not expected: [%s]", actual)
+		}
+	})
+
+	t.Run("Concurrency", func(t *testing.T) {
+		var running, maxRunning atomic.Int32
+		machines := newFleetTestMachines("a", "b", "c", "d", "e")
+		for i, machine := range machines {
+			machines[i] = &concurrencyTestMachine{Machine: machine, running: &running, maxRunning: &maxRunning}
+		}
+		fleet := &Fleet{Machines: machines, Concurrency: 2}
+
+		results, err := fleet.RunCmd(context.Background(), NewCommandInOut(nil, nil, nil, nil), "", "sleep", "0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maxRunning.Load() != 2 {
+			t.Fatalf("expected 2 concurrent commands, got %d", maxRunning.Load())
+		}
+		for _, r := range results {
+			if r.Duration() < 100*time.Millisecond {
+				t.Fatalf("not expected: %+v", r)
+			}
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		fleet := NewFleet(newFleetTestMachines("a", "b")...)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		results, err := fleet.RunCmd(ctx, NewCommandInOut(nil, nil, nil, nil), "", "true")
+		if !errors.Is(err, ErrCanceled) {
+			t.Fatalf("expected ErrCanceled, got: %v", err)
+		}
+		for _, r := range results {
+			if !r.Skipped || !errors.Is(r.Err, ErrCanceled) || r.Success() {
+				t.Fatalf("expected skipped: %+v", r)
+			}
+		}
+	})
+
+	t.Run("FailFast", func(t *testing.T) {
+		fleet := &Fleet{Machines: newFleetTestMachines("a", "b!", "c", "d"), Concurrency: 2, FailFast: true}
+
+		start := time.Now()
+		results, err := fleet.RunCmd(context.Background(), NewCommandInOut(nil, nil, nil, nil), "", "sleep", "10")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("commands were not canceled in time: %s", elapsed)
+		}
+		if !errors.Is(results[0].Err, ErrCanceled) {
+			t.Fatalf("expected ErrCanceled, got: %v", results[0].Err)
+		}
+		if results[1].ExitCode() != 3 {
+			t.Fatalf("not expected: %+v", results[1])
+		}
+		for _, r := range results[2:] {
+			if !r.Skipped || r.Result != nil || r.Err != nil {
+				t.Fatalf("expected skipped: %+v", r)
+			}
+		}
+	})
+}
+
+type concurrencyTestMachine struct {
+	Machine
+	running    *atomic.Int32
+	maxRunning *atomic.Int32
+}
+
+func (m *concurrencyTestMachine) RunCmdWithResult(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (*CommandResult, error) {
+	n := m.running.Add(1)
+	defer m.running.Add(-1)
+	for {
+		current := m.maxRunning.Load()
+		if n <= current || m.maxRunning.CompareAndSwap(current, n) {
+			break
+		}
+	}
+	return m.Machine.RunCmdWithResult(ctx, io, dir, command, arg...)
+}
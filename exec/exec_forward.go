@@ -0,0 +1,358 @@
+package exec
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrForwardingNotSupported is returned when a machine cannot forward ports.
+var ErrForwardingNotSupported = errors.New("port forwarding not supported")
+
+// sshClientProvider is implemented by machines giving access to their SSH client.
+type sshClientProvider interface {
+	sshClient(ctx context.Context) (*ssh.Client, func(), error)
+}
+
+// sshClient implements sshClientProvider, the returned function releases the shared connection.
+func (rc *sshExecutionContext) sshClient(ctx context.Context) (*ssh.Client, func(), error) {
+	client, err := rc.conn.acquire(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to establish SSH connection", err)
+	}
+	return client, rc.conn.release, nil
+}
+
+func machineSshClient(ctx context.Context, machine Machine) (*ssh.Client, func(), error) {
+	provider, ok := machine.(sshClientProvider)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrForwardingNotSupported, machine.Host())
+	}
+	return provider.sshClient(ctx)
+}
+
+// PortForward is an active port forwarding. It keeps the SSH connection of the machine open
+// until it is closed, and it is closed when the connection is lost or the machine is closed.
+type PortForward struct {
+	listener net.Listener
+	dial     func(conn net.Conn) (net.Conn, error)
+	release  func()
+
+	active    atomic.Int32
+	mutex     sync.Mutex
+	conns     map[net.Conn]struct{}
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// LocalForward listens on localAddress and forwards every connection to remoteAddress
+// as seen from the machine, like ssh -L. The context is only used to connect.
+//
+//goland:noinspection GoUnusedExportedFunction
+func LocalForward(ctx context.Context, machine Machine, localAddress, remoteAddress string) (*PortForward, error) {
+	client, release, err := machineSshClient(ctx, machine)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%w: cannot listen on %s", err, localAddress)
+	}
+	return startPortForward(client, listener, release, func(net.Conn) (net.Conn, error) {
+		return client.Dial("tcp", remoteAddress)
+	}), nil
+}
+
+// RemoteForward listens on remoteAddress on the machine and forwards every connection to
+// localAddress, like ssh -R. The SSH server must allow it, see AllowTcpForwarding in sshd_config.
+//
+//goland:noinspection GoUnusedExportedFunction
+func RemoteForward(ctx context.Context, machine Machine, remoteAddress, localAddress string) (*PortForward, error) {
+	client, release, err := machineSshClient(ctx, machine)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.Listen("tcp", remoteAddress)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%w: cannot listen on %s on %s", err, remoteAddress, machine.Host())
+	}
+	return startPortForward(client, listener, release, func(net.Conn) (net.Conn, error) {
+		return net.Dial("tcp", localAddress)
+	}), nil
+}
+
+// DynamicForward runs a SOCKS5 proxy on localAddress connecting through the machine, like ssh -D.
+// Only the CONNECT command without authentication is supported.
+//
+//goland:noinspection GoUnusedExportedFunction
+func DynamicForward(ctx context.Context, machine Machine, localAddress string) (*PortForward, error) {
+	client, release, err := machineSshClient(ctx, machine)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%w: cannot listen on %s", err, localAddress)
+	}
+	return startPortForward(client, listener, release, func(conn net.Conn) (net.Conn, error) {
+		return socks5Connect(conn, client, socks5HandshakeTimeout)
+	}), nil
+}
+
+func startPortForward(client *ssh.Client, listener net.Listener, release func(), dial func(conn net.Conn) (net.Conn, error)) *PortForward {
+	f := &PortForward{
+		listener: listener,
+		dial:     dial,
+		release:  release,
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	go f.serve()
+	go func() {
+		select {
+		case <-f.done:
+		case <-clientClosed(client):
+			_ = f.Close()
+		}
+	}()
+	return f
+}
+
+// clientClosed returns a channel closed once the SSH connection is gone.
+func clientClosed(client *ssh.Client) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	return closed
+}
+
+// Addr returns the address listened on, e.g. to find the port chosen for ":0".
+func (f *PortForward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// ActiveConnections returns the number of connections being forwarded.
+func (f *PortForward) ActiveConnections() int {
+	return int(f.active.Load())
+}
+
+// Done is closed when the forwarding has stopped.
+func (f *PortForward) Done() <-chan struct{} {
+	return f.done
+}
+
+// Close stops listening, closes the forwarded connections and releases the SSH connection.
+func (f *PortForward) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		f.mutex.Lock()
+		f.closed = true
+		for conn := range f.conns {
+			_ = conn.Close()
+		}
+		f.mutex.Unlock()
+
+		err = f.listener.Close()
+		f.wg.Wait()
+		f.release()
+		close(f.done)
+	})
+	return err
+}
+
+func (f *PortForward) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !f.track(conn, true) {
+			_ = conn.Close()
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+// track registers a connection to be closed by Close, it returns false once closed.
+// Accepted connections are also waited for by Close.
+func (f *PortForward) track(conn net.Conn, accepted bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	if accepted {
+		f.wg.Add(1)
+	}
+	return true
+}
+
+func (f *PortForward) untrack(conn net.Conn) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.conns, conn)
+}
+
+func (f *PortForward) forward(conn net.Conn) {
+	defer f.wg.Done()
+	defer f.untrack(conn)
+	defer conn.Close()
+
+	target, err := f.dial(conn)
+	if err != nil {
+		return
+	}
+	if !f.track(target, false) {
+		_ = target.Close()
+		return
+	}
+	defer f.untrack(target)
+	defer target.Close()
+
+	f.active.Add(1)
+	defer f.active.Add(-1)
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(target, conn)
+		closeWrite(target)
+		close(done)
+	}()
+	_, _ = io.Copy(conn, target)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite half-closes conn so that the peer sees the end of the stream.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
+
+const (
+	// socks5HandshakeTimeout bounds the handshake of a client, an idle client is disconnected
+	socks5HandshakeTimeout = 30 * time.Second
+
+	socks5Version          = 5
+	socks5NoAuth           = 0
+	socks5NoAcceptable     = 0xff
+	socks5CmdConnect       = 1
+	socks5AddrIPv4         = 1
+	socks5AddrDomain       = 3
+	socks5AddrIPv6         = 4
+	socks5Succeeded        = 0
+	socks5HostUnreachable  = 4
+	socks5CmdNotSupported  = 7
+	socks5AddrNotSupported = 8
+)
+
+// socks5Connect runs the SOCKS5 handshake of RFC 1928 on conn and connects to the requested
+// address through the SSH client. The client has timeout to send its requests.
+func socks5Connect(conn net.Conn, client *ssh.Client, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5NoAcceptable {
+		return nil, errors.New("no acceptable SOCKS authentication method")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5CmdNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if request[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5AddrNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+
+	target, err := client.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		socks5Reply(conn, socks5HostUnreachable)
+		return nil, err
+	}
+	socks5Reply(conn, socks5Succeeded)
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// socks5Reply sends a reply with an empty IPv4 bound address.
+func socks5Reply(conn net.Conn, status byte) {
+	_, _ = conn.Write([]byte{socks5Version, status, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+}
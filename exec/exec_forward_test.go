@@ -0,0 +1,241 @@
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startEchoServer answers every line with "echo: " followed by the line.
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = conn.Write([]byte("echo: " + scanner.Text() + "\n"))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "echo: hello\n" {
+		t.Fatalf("not expected: [%s]", line)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	server := newTestSshServer(t)
+	echoAddress := startEchoServer(t)
+	ctx := context.Background()
+
+	t.Run("Local", func(t *testing.T) {
+		machine := server.machine()
+		forward, err := LocalForward(ctx, machine, "127.0.0.1:0", echoAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer forward.Close()
+
+		conn, err := net.Dial("tcp", forward.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		if active := forward.ActiveConnections(); active != 1 {
+			t.Fatalf("expected 1 active connection, got %d", active)
+		}
+		_ = conn.Close()
+		waitFor(t, func() bool {
+			return forward.ActiveConnections() == 0
+		})
+
+		if err := forward.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := net.Dial("tcp", forward.Addr().String()); err == nil {
+			_ = conn.Close()
+			t.Fatal("expected closed listener")
+		}
+	})
+
+	t.Run("Remote", func(t *testing.T) {
+		machine := server.machine()
+		forward, err := RemoteForward(ctx, machine, "127.0.0.1:0", echoAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer forward.Close()
+
+		conn, err := net.Dial("tcp", forward.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("Dynamic", func(t *testing.T) {
+		machine := server.machine()
+		forward, err := DynamicForward(ctx, machine, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer forward.Close()
+
+		conn, err := net.Dial("tcp", forward.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		reply := make([]byte, 2)
+		if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+			t.Fatalf("not expected method reply %v: %v", reply, err)
+		}
+
+		addr, err := net.ResolveTCPAddr("tcp", echoAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := append([]byte{5, 1, 0, 1}, addr.IP.To4()...)
+		request = binary.BigEndian.AppendUint16(request, uint16(addr.Port))
+		if _, err := conn.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		reply = make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+			t.Fatalf("not expected connect reply %v: %v", reply, err)
+		}
+		assertEcho(t, conn)
+	})
+
+	t.Run("Dynamic handshake", func(t *testing.T) {
+		client, release, err := machineSshClient(ctx, server.machine())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		addr, err := net.ResolveTCPAddr("tcp", echoAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshake := func(conn net.Conn, version byte) {
+			reply := make([]byte, 10)
+			request := append([]byte{version, 1, 0, 1}, addr.IP.To4()...)
+			request = binary.BigEndian.AppendUint16(request, uint16(addr.Port))
+			_, _ = conn.Write([]byte{5, 1, 0})
+			_, _ = io.ReadFull(conn, reply[:2])
+			_, _ = conn.Write(request)
+			_, _ = io.ReadFull(conn, reply)
+		}
+
+		t.Run("Idle client", func(t *testing.T) {
+			conn, proxy := net.Pipe()
+			defer conn.Close()
+			defer proxy.Close()
+
+			if _, err := socks5Connect(proxy, client, 50*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("expected timeout, got: %v", err)
+			}
+		})
+
+		t.Run("Version of the request", func(t *testing.T) {
+			conn, proxy := net.Pipe()
+			defer conn.Close()
+			defer proxy.Close()
+
+			go handshake(conn, 4)
+			if _, err := socks5Connect(proxy, client, time.Second); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+
+		t.Run("No deadline once connected", func(t *testing.T) {
+			conn, proxy := net.Pipe()
+			defer conn.Close()
+			defer proxy.Close()
+
+			go func() {
+				handshake(conn, 5)
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.Write([]byte("x"))
+			}()
+			target, err := socks5Connect(proxy, client, 50*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			if _, err := proxy.Read(make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+
+	t.Run("Closed with the machine", func(t *testing.T) {
+		machine := server.machine()
+		forward, err := LocalForward(ctx, machine, "127.0.0.1:0", echoAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := machine.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-forward.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("forward not closed with the machine")
+		}
+	})
+
+	t.Run("Not supported", func(t *testing.T) {
+		machine := &testExecutionContext{user: "user", host: "host"}
+		if _, err := LocalForward(ctx, machine, "127.0.0.1:0", echoAddress); !errors.Is(err, ErrForwardingNotSupported) {
+			t.Fatalf("expected not supported, got %v", err)
+		}
+	})
+}
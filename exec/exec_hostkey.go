@@ -0,0 +1,179 @@
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrHostKeyUnknown is returned when the host is not in any known_hosts file.
+	ErrHostKeyUnknown = errors.New("host key unknown")
+	// ErrHostKeyMismatch is returned when the host presents a key different from the known or pinned ones.
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	// ErrHostKeyRevoked is returned when the host key is marked as @revoked.
+	ErrHostKeyRevoked = errors.New("host key revoked")
+)
+
+// HostKeyError is returned by the host key callbacks of this package when a host key is rejected.
+// It matches ErrHostKeyUnknown, ErrHostKeyMismatch or ErrHostKeyRevoked with errors.Is.
+type HostKeyError struct {
+	// Host is the address the client connected to.
+	Host string
+	// Fingerprint is the SHA-256 fingerprint of the key presented by the host.
+	Fingerprint string
+	// Expected are the fingerprints of the keys accepted for the host.
+	Expected []string
+	Err      error
+}
+
+func (e *HostKeyError) Error() string {
+	msg := fmt.Sprintf("%v for %s: %s", e.Err, e.Host, e.Fingerprint)
+	if len(e.Expected) > 0 {
+		msg = fmt.Sprintf("%s, expected %s", msg, strings.Join(e.Expected, " or "))
+	}
+	return msg
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.Err
+}
+
+// StrictHostKeyCallback verifies host keys against the known_hosts files. Hashed host names,
+// @cert-authority and @revoked markers are supported, unknown hosts are rejected.
+//
+//goland:noinspection GoUnusedExportedFunction
+func StrictHostKeyCallback(knownHostsFiles ...string) (ssh.HostKeyCallback, error) {
+	db, err := knownhosts.New(knownHostsFiles...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read known hosts files", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return hostKeyError(hostname, key, db(hostname, remote, key))
+	}, nil
+}
+
+// TrustOnFirstUseHostKeyCallback verifies host keys like StrictHostKeyCallback, but the key of
+// an unknown host is accepted and appended to knownHostsFile, which is created when missing.
+// Like OpenSSH "StrictHostKeyChecking accept-new", a changed key is still rejected.
+//
+//goland:noinspection GoUnusedExportedFunction
+func TrustOnFirstUseHostKeyCallback(knownHostsFile string) (ssh.HostKeyCallback, error) {
+	if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0o700); err != nil {
+		return nil, fmt.Errorf("%w: cannot create known hosts directory", err)
+	}
+	file, err := os.OpenFile(knownHostsFile, os.O_CREATE|os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot create known hosts file", err)
+	}
+	_ = file.Close()
+
+	db, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read known hosts file %s", err, knownHostsFile)
+	}
+
+	var mutex sync.Mutex
+	// keys accepted since the file has been read
+	accepted := make(map[string]ssh.PublicKey)
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := db(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return hostKeyError(hostname, key, err)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		address := knownhosts.Normalize(hostname)
+		if known, ok := accepted[address]; ok {
+			if bytes.Equal(known.Marshal(), key.Marshal()) {
+				return nil
+			}
+			return &HostKeyError{
+				Host:        hostname,
+				Fingerprint: ssh.FingerprintSHA256(key),
+				Expected:    []string{ssh.FingerprintSHA256(known)},
+				Err:         ErrHostKeyMismatch,
+			}
+		}
+
+		if err := appendKnownHost(knownHostsFile, address, key); err != nil {
+			return err
+		}
+		accepted[address] = key
+		return nil
+	}, nil
+}
+
+func appendKnownHost(knownHostsFile string, address string, key ssh.PublicKey) error {
+	file, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("%w: cannot open known hosts file", err)
+	}
+	_, err = fmt.Fprintln(file, knownhosts.Line([]string{address}, key))
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("%w: cannot write known hosts file", err)
+	}
+	return closeErr
+}
+
+// PinnedHostKeyCallback accepts only host keys with one of the SHA-256 fingerprints,
+// in the format of ssh-keygen -l, e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+//
+//goland:noinspection GoUnusedExportedFunction
+func PinnedHostKeyCallback(fingerprints ...string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, pinned := range fingerprints {
+			if pinned == fingerprint {
+				return nil
+			}
+		}
+		return &HostKeyError{
+			Host:        hostname,
+			Fingerprint: fingerprint,
+			Expected:    fingerprints,
+			Err:         ErrHostKeyMismatch,
+		}
+	}
+}
+
+// hostKeyError converts the errors of a knownhosts callback to a HostKeyError.
+func hostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	if err == nil {
+		return nil
+	}
+	hostKeyErr := &HostKeyError{
+		Host:        hostname,
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}
+
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	switch {
+	case errors.As(err, &revokedErr):
+		hostKeyErr.Err = ErrHostKeyRevoked
+	case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+		hostKeyErr.Err = ErrHostKeyUnknown
+	case errors.As(err, &keyErr):
+		hostKeyErr.Err = ErrHostKeyMismatch
+		for _, want := range keyErr.Want {
+			hostKeyErr.Expected = append(hostKeyErr.Expected, ssh.FingerprintSHA256(want.Key))
+		}
+	default:
+		// e.g. a certificate signed by an unknown authority
+		hostKeyErr.Err = fmt.Errorf("%w: %w", ErrHostKeyMismatch, err)
+	}
+	return hostKeyErr
+}
@@ -0,0 +1,174 @@
+package exec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestHostKeyCallbacks(t *testing.T) {
+	const host = "server.example.com:22"
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	hostKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+
+	ca := newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             hostKey,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"server.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	knownHosts := func(name string, lines ...string) string {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, strings.Join(lines, "\n")+"\n")
+		return path
+	}
+	known := knownHosts("known", knownhosts.Line([]string{"server.example.com"}, hostKey))
+	hashed := knownHosts("hashed", knownhosts.Line([]string{knownhosts.HashHostname("server.example.com")}, hostKey))
+	other := knownHosts("other", knownhosts.Line([]string{"other.example.com"}, otherKey))
+	mismatch := knownHosts("mismatch", knownhosts.Line([]string{"server.example.com"}, otherKey))
+	revoked := knownHosts("revoked", "@revoked * "+string(ssh.MarshalAuthorizedKey(hostKey)))
+	authority := knownHosts("authority", "@cert-authority *.example.com "+string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+
+	tests := []struct {
+		name     string
+		files    []string
+		key      ssh.PublicKey
+		expected error
+	}{
+		{name: "known", files: []string{other, known}, key: hostKey},
+		{name: "hashed", files: []string{hashed}, key: hostKey},
+		{name: "unknown", files: []string{other}, key: hostKey, expected: ErrHostKeyUnknown},
+		{name: "no files", key: hostKey, expected: ErrHostKeyUnknown},
+		{name: "mismatch", files: []string{mismatch}, key: hostKey, expected: ErrHostKeyMismatch},
+		{name: "revoked", files: []string{revoked, known}, key: hostKey, expected: ErrHostKeyRevoked},
+		{name: "cert-authority", files: []string{authority}, key: cert},
+		{name: "cert-authority unknown", files: []string{known}, key: cert, expected: ErrHostKeyMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			callback, err := StrictHostKeyCallback(test.files...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = callback(host, remote, test.key)
+			if !errors.Is(err, test.expected) || (test.expected == nil && err != nil) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	t.Run("mismatch error", func(t *testing.T) {
+		callback, err := StrictHostKeyCallback(mismatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hostKeyErr *HostKeyError
+		if !errors.As(callback(host, remote, hostKey), &hostKeyErr) {
+			t.Fatal("expected HostKeyError")
+		}
+		if hostKeyErr.Fingerprint != ssh.FingerprintSHA256(hostKey) ||
+			len(hostKeyErr.Expected) != 1 || hostKeyErr.Expected[0] != ssh.FingerprintSHA256(otherKey) {
+			t.Fatalf("not expected: %v", hostKeyErr)
+		}
+	})
+
+	t.Run("trust on first use", func(t *testing.T) {
+		path := filepath.Join(dir, "tofu", "known_hosts")
+		callback, err := TrustOnFirstUseHostKeyCallback(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := callback(host, remote, hostKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := callback(host, remote, hostKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := callback(host, remote, otherKey); !errors.Is(err, ErrHostKeyMismatch) {
+			t.Fatalf("expected mismatch, got %v", err)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(content), "\n"); lines != 1 {
+			t.Fatalf("expected 1 line, got:\n%s", content)
+		}
+
+		strict, err := StrictHostKeyCallback(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := strict(host, remote, hostKey); err != nil {
+			t.Fatal(err)
+		}
+
+		reloaded, err := TrustOnFirstUseHostKeyCallback(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reloaded(host, remote, otherKey); !errors.Is(err, ErrHostKeyMismatch) {
+			t.Fatalf("expected mismatch, got %v", err)
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		callback := PinnedHostKeyCallback(ssh.FingerprintSHA256(otherKey), ssh.FingerprintSHA256(hostKey))
+		if err := callback(host, remote, hostKey); err != nil {
+			t.Fatal(err)
+		}
+		callback = PinnedHostKeyCallback(ssh.FingerprintSHA256(otherKey))
+		if err := callback(host, remote, hostKey); !errors.Is(err, ErrHostKeyMismatch) {
+			t.Fatalf("expected mismatch, got %v", err)
+		}
+	})
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	server := newTestSshServer(t)
+
+	config := server.clientConfig()
+	config.HostKeyCallback = PinnedHostKeyCallback("SHA256:invalid")
+	config.Timeout = 5 * time.Second
+	machine := NewSshMachine("127.0.0.1", server.port(), config)
+	defer machine.Close()
+
+	_, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+	var hostKeyErr *HostKeyError
+	if !errors.As(err, &hostKeyErr) || !errors.Is(err, ErrConnection) {
+		t.Fatalf("expected HostKeyError, got %v", err)
+	}
+	if hostKeyErr.Fingerprint != ssh.FingerprintSHA256(server.hostKey) {
+		t.Fatalf("not expected fingerprint: %s", hostKeyErr.Fingerprint)
+	}
+}
@@ -0,0 +1,512 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// allGroup is the implicit group of all hosts of an inventory.
+const allGroup = "all"
+
+// ErrInvalidInventory is returned when an inventory file has invalid entries.
+var ErrInvalidInventory = errors.New("invalid inventory")
+
+// InventorySettings are the connection settings and variables of a host, also used as defaults
+// of the inventory and of groups.
+type InventorySettings struct {
+	User string `yaml:"user,omitempty" json:"user,omitempty"`
+	Port int    `yaml:"port,omitempty" json:"port,omitempty"`
+	// Key is the path of the private key, relative to the directory of the inventory file.
+	Key string `yaml:"key,omitempty" json:"key,omitempty"`
+	// Jump is the name of another host of the inventory, or [user@]host[:port], to connect through.
+	Jump string `yaml:"jump,omitempty" json:"jump,omitempty"`
+	// KnownHosts is the known_hosts file, relative to the directory of the inventory file.
+	KnownHosts string `yaml:"known_hosts,omitempty" json:"known_hosts,omitempty"`
+	// StrictHostKeyChecking is yes, no or accept-new like in ssh_config(5).
+	StrictHostKeyChecking string `yaml:"strict_host_key_checking,omitempty" json:"strict_host_key_checking,omitempty"`
+	// Vars are metadata of the host for the caller, see Entry. They are not passed to the machine,
+	// e.g. as environment variables.
+	Vars map[string]string `yaml:"vars,omitempty" json:"vars,omitempty"`
+}
+
+// InventoryHost is a host of an inventory.
+type InventoryHost struct {
+	InventorySettings `yaml:",inline"`
+	// Host is the host name or address, by default the name of the entry.
+	Host string `yaml:"host,omitempty" json:"host,omitempty"`
+	// Local runs the commands on the local machine instead of over SSH.
+	Local  bool     `yaml:"local,omitempty" json:"local,omitempty"`
+	Tags   []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Groups []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+}
+
+// InventoryGroup is a named set of hosts and of other groups sharing default settings.
+type InventoryGroup struct {
+	Hosts    []string          `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	Children []string          `yaml:"children,omitempty" json:"children,omitempty"`
+	Defaults InventorySettings `yaml:"defaults,omitempty" json:"defaults,omitempty"`
+}
+
+// Inventory describes machines and groups of machines, e.g.
+//
+//	defaults:
+//	  user: deploy
+//	  key: keys/deploy
+//	hosts:
+//	  bastion:
+//	    host: bastion.example.com
+//	  web1:
+//	    host: 10.0.0.11
+//	    tags: [nginx]
+//	  db1:
+//	    host: 10.0.0.21
+//	    port: 2222
+//	groups:
+//	  web:
+//	    hosts: [web1]
+//	  private:
+//	    children: [web]
+//	    hosts: [db1]
+//	    defaults:
+//	      jump: bastion
+//
+// The settings of a host override the defaults of its groups, the defaults of a group override the
+// ones of its parent groups and the defaults of the inventory. Between groups at the same distance
+// of a host the first by name wins. The group "all" contains every host.
+type Inventory struct {
+	Defaults InventorySettings         `yaml:"defaults,omitempty" json:"defaults,omitempty"`
+	Hosts    map[string]InventoryHost  `yaml:"hosts" json:"hosts"`
+	Groups   map[string]InventoryGroup `yaml:"groups,omitempty" json:"groups,omitempty"`
+
+	// dir resolves relative paths
+	dir string
+}
+
+// InventoryEntry is a host of an inventory with the settings of its groups applied.
+type InventoryEntry struct {
+	InventorySettings
+	Name   string
+	Host   string
+	Local  bool
+	Tags   []string
+	Groups []string
+}
+
+// LoadInventory reads a YAML inventory file, or a JSON one when its extension is .json, and validates it.
+// Relative paths of the inventory are resolved against the directory of the file.
+//
+//goland:noinspection GoUnusedExportedFunction
+func LoadInventory(path string) (*Inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inventory *Inventory
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		inventory, err = ParseInventoryJson(data, filepath.Dir(path))
+	} else {
+		inventory, err = ParseInventoryYaml(data, filepath.Dir(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, path)
+	}
+	return inventory, nil
+}
+
+// ParseInventoryYaml parses and validates a YAML inventory, relative paths are resolved against dir.
+//
+//goland:noinspection GoUnusedExportedFunction
+func ParseInventoryYaml(data []byte, dir string) (*Inventory, error) {
+	inventory := &Inventory{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(inventory); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInventory, err)
+	}
+	return inventory.init(dir)
+}
+
+// ParseInventoryJson parses and validates a JSON inventory, relative paths are resolved against dir.
+//
+//goland:noinspection GoUnusedExportedFunction
+func ParseInventoryJson(data []byte, dir string) (*Inventory, error) {
+	inventory := &Inventory{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(inventory); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInventory, err)
+	}
+	return inventory.init(dir)
+}
+
+func (inv *Inventory) init(dir string) (*Inventory, error) {
+	inv.dir = dir
+	if err := inv.Validate(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Validate checks the hosts, the ports and the references between hosts and groups.
+func (inv *Inventory) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidInventory}, args...)...))
+	}
+	validateSettings := func(what string, settings InventorySettings) {
+		if settings.Port < 0 || settings.Port > 65535 {
+			invalid("%s: port %d out of range", what, settings.Port)
+		}
+		switch settings.StrictHostKeyChecking {
+		case "", "yes", "no", "off", "accept-new":
+		default:
+			invalid("%s: unknown strict_host_key_checking %q", what, settings.StrictHostKeyChecking)
+		}
+	}
+
+	if len(inv.Hosts) == 0 {
+		invalid("no hosts")
+	}
+	validateSettings("defaults", inv.Defaults)
+	for _, name := range sortedKeys(inv.Hosts) {
+		host := inv.Hosts[name]
+		if name == "" || strings.ContainsAny(name, " \t,") {
+			invalid("invalid host name %q", name)
+		}
+		if _, ok := inv.Groups[name]; ok || name == allGroup {
+			invalid("host %s: name already used by a group", name)
+		}
+		validateSettings("host "+name, host.InventorySettings)
+		for _, group := range host.Groups {
+			if _, ok := inv.Groups[group]; !ok {
+				invalid("host %s: unknown group %s", name, group)
+			}
+		}
+	}
+	for _, name := range sortedKeys(inv.Groups) {
+		group := inv.Groups[name]
+		if name == allGroup {
+			invalid("group %s is reserved", allGroup)
+		}
+		validateSettings("group "+name, group.Defaults)
+		for _, host := range group.Hosts {
+			if _, ok := inv.Hosts[host]; !ok {
+				invalid("group %s: unknown host %s", name, host)
+			}
+		}
+		for _, child := range group.Children {
+			if _, ok := inv.Groups[child]; !ok {
+				invalid("group %s: unknown child group %s", name, child)
+			}
+		}
+		if inv.groupCycle(name, nil) {
+			invalid("group %s: cycle of child groups", name)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// jump hosts are resolved once the groups are valid
+	for _, name := range sortedKeys(inv.Hosts) {
+		if _, err := inv.jumpChain(name, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// groupCycle reports whether name is reachable from its own children.
+func (inv *Inventory) groupCycle(name string, path []string) bool {
+	if slices.Contains(path, name) {
+		return true
+	}
+	for _, child := range inv.Groups[name].Children {
+		if _, ok := inv.Groups[child]; ok && inv.groupCycle(child, append(path, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostNames returns the names of all hosts, sorted.
+func (inv *Inventory) HostNames() []string {
+	return sortedKeys(inv.Hosts)
+}
+
+// Group returns the names of the hosts of the group and of its child groups, sorted.
+func (inv *Inventory) Group(name string) ([]string, error) {
+	if name == allGroup {
+		return inv.HostNames(), nil
+	}
+	if _, ok := inv.Groups[name]; !ok {
+		return nil, fmt.Errorf("unknown group %s", name)
+	}
+	var hosts []string
+	for _, host := range inv.HostNames() {
+		if _, ok := inv.hostGroups(host)[name]; ok {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// Tagged returns the names of the hosts with the tag, sorted.
+func (inv *Inventory) Tagged(tag string) []string {
+	var hosts []string
+	for _, name := range inv.HostNames() {
+		if slices.Contains(inv.Hosts[name].Tags, tag) {
+			hosts = append(hosts, name)
+		}
+	}
+	return hosts
+}
+
+// hostGroups returns the groups of the host, directly or through child groups, with their distance.
+func (inv *Inventory) hostGroups(host string) map[string]int {
+	distances := make(map[string]int)
+	var visit func(group string, distance int)
+	visit = func(group string, distance int) {
+		if d, ok := distances[group]; ok && d <= distance {
+			return
+		}
+		distances[group] = distance
+		for _, parent := range sortedKeys(inv.Groups) {
+			if slices.Contains(inv.Groups[parent].Children, group) {
+				visit(parent, distance+1)
+			}
+		}
+	}
+	for _, group := range inv.Hosts[host].Groups {
+		visit(group, 0)
+	}
+	for _, name := range sortedKeys(inv.Groups) {
+		if slices.Contains(inv.Groups[name].Hosts, host) {
+			visit(name, 0)
+		}
+	}
+	return distances
+}
+
+// Entry returns the host with the defaults of the inventory and of its groups applied.
+func (inv *Inventory) Entry(name string) (InventoryEntry, error) {
+	host, ok := inv.Hosts[name]
+	if !ok {
+		return InventoryEntry{}, fmt.Errorf("unknown host %s", name)
+	}
+	distances := inv.hostGroups(name)
+	groups := sortedKeys(distances)
+	// the farthest groups first, the closest override them
+	ordered := slices.Clone(groups)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		if distances[a] != distances[b] {
+			return distances[b] - distances[a]
+		}
+		return strings.Compare(b, a)
+	})
+
+	settings := inv.Defaults.merge(InventorySettings{})
+	for _, group := range ordered {
+		settings = settings.merge(inv.Groups[group].Defaults)
+	}
+	settings = settings.merge(host.InventorySettings)
+	settings.Key = inv.path(settings.Key)
+	settings.KnownHosts = inv.path(settings.KnownHosts)
+
+	entry := InventoryEntry{
+		InventorySettings: settings,
+		Name:              name,
+		Host:              host.Host,
+		Local:             host.Local,
+		Tags:              host.Tags,
+		Groups:            groups,
+	}
+	if entry.Host == "" {
+		entry.Host = name
+	}
+	return entry, nil
+}
+
+// merge returns the settings of s overridden by the ones set in other.
+func (s InventorySettings) merge(other InventorySettings) InventorySettings {
+	merged := s
+	if other.User != "" {
+		merged.User = other.User
+	}
+	if other.Port != 0 {
+		merged.Port = other.Port
+	}
+	if other.Key != "" {
+		merged.Key = other.Key
+	}
+	if other.Jump != "" {
+		merged.Jump = other.Jump
+	}
+	if other.KnownHosts != "" {
+		merged.KnownHosts = other.KnownHosts
+	}
+	if other.StrictHostKeyChecking != "" {
+		merged.StrictHostKeyChecking = other.StrictHostKeyChecking
+	}
+	merged.Vars = make(map[string]string, len(s.Vars)+len(other.Vars))
+	for k, v := range s.Vars {
+		merged.Vars[k] = v
+	}
+	for k, v := range other.Vars {
+		merged.Vars[k] = v
+	}
+	return merged
+}
+
+// path resolves a path of the inventory against its directory.
+func (inv *Inventory) path(p string) string {
+	p = expandHome(p)
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(inv.dir, p)
+}
+
+// hostConfig converts the entry to the OpenSSH client configuration of a host.
+func (e InventoryEntry) hostConfig() SshHostConfig {
+	hc := SshHostConfig{
+		Alias:                 e.Name,
+		HostName:              e.Host,
+		User:                  e.User,
+		Port:                  e.Port,
+		UserKnownHostsFile:    e.KnownHosts,
+		StrictHostKeyChecking: e.StrictHostKeyChecking,
+	}
+	if hc.User == "" {
+		hc.User = localUserName()
+	}
+	if hc.Port == 0 {
+		hc.Port = 22
+	}
+	if e.Key != "" {
+		hc.IdentityFiles = []string{e.Key}
+	}
+	return hc
+}
+
+// jumpChain returns the entries of the jump hosts of the host, the first one connected first.
+// A jump which is not a host of the inventory is returned as an entry of [user@]host[:port].
+func (inv *Inventory) jumpChain(name string, path []string) ([]InventoryEntry, error) {
+	if slices.Contains(path, name) {
+		return nil, fmt.Errorf("%w: host %s: cycle of jump hosts", ErrInvalidInventory, path[0])
+	}
+	entry, err := inv.Entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Jump == "" {
+		return nil, nil
+	}
+	if _, ok := inv.Hosts[entry.Jump]; !ok {
+		return []InventoryEntry{{Name: entry.Jump}}, nil
+	}
+	chain, err := inv.jumpChain(entry.Jump, append(path, name))
+	if err != nil {
+		return nil, err
+	}
+	jump, _ := inv.Entry(entry.Jump)
+	if jump.Local {
+		return nil, fmt.Errorf("%w: host %s: jump host %s is local", ErrInvalidInventory, name, jump.Name)
+	}
+	return append(chain, jump), nil
+}
+
+// Machine creates the machine of the host: NewLocalMachine for local hosts, NewSshMachine otherwise.
+// The keys of the ssh-agent and the key of the host are used for authentication, an encrypted key
+// is decrypted with the WithPassphrase option. The options are passed to NewSshMachine.
+func (inv *Inventory) Machine(name string, options ...SshOption) (Machine, error) {
+	entry, err := inv.Entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Local {
+		return NewLocalMachine(entry.User), nil
+	}
+
+	passphrase := passphraseOption(options)
+	hc := entry.hostConfig()
+	sshConfig, err := hc.clientConfig(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := inv.jumpChain(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jumpHosts []JumpHost
+	var proxyJump []string
+	for _, jump := range chain {
+		if _, ok := inv.Hosts[jump.Name]; !ok {
+			// not in the inventory, the address is looked up like in ProxyJump
+			hosts, err := (&SshConfigFile{}).jumpHosts(jump.Name, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			jumpHosts = append(jumpHosts, hosts...)
+			proxyJump = append(proxyJump, jump.Name)
+			continue
+		}
+		jumpConfig := jump.hostConfig()
+		jumpSshConfig, err := jumpConfig.clientConfig(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%w: jump host %s", err, jump.Name)
+		}
+		jumpHost := JumpHost{Host: jumpConfig.HostName, Port: jumpConfig.Port, SshConfig: jumpSshConfig}
+		jumpHosts = append(jumpHosts, jumpHost)
+		proxyJump = append(proxyJump, jumpHost.String())
+	}
+
+	hc.ProxyJump = strings.Join(proxyJump, ",")
+	sshOptions := []SshOption{WithSshCommandOptions(hc.sshCommandOptions())}
+	if len(jumpHosts) > 0 {
+		sshOptions = append(sshOptions, WithJumpHosts(jumpHosts...))
+	}
+	return NewSshMachine(hc.HostName, hc.Port, sshConfig, append(sshOptions, options...)...), nil
+}
+
+// Machines creates the machines of the hosts, closing the ones already created on error.
+func (inv *Inventory) Machines(names []string, options ...SshOption) ([]Machine, error) {
+	machines := make([]Machine, 0, len(names))
+	for _, name := range names {
+		machine, err := inv.Machine(name, options...)
+		if err != nil {
+			for _, m := range machines {
+				_ = m.Close()
+			}
+			return nil, err
+		}
+		machines = append(machines, machine)
+	}
+	return machines, nil
+}
+
+// GroupMachines creates the machines of the hosts of the group, see Group.
+func (inv *Inventory) GroupMachines(group string, options ...SshOption) ([]Machine, error) {
+	names, err := inv.Group(group)
+	if err != nil {
+		return nil, err
+	}
+	return inv.Machines(names, options...)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
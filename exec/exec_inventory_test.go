@@ -0,0 +1,216 @@
+package exec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestInventory(t *testing.T) {
+	dir := t.TempDir()
+	inventoryPath := filepath.Join(dir, "inventory.yaml")
+	writeTestFile(t, inventoryPath, `
+defaults:
+  user: deploy
+  key: keys/deploy
+  vars:
+    env: prod
+hosts:
+  bastion:
+    host: bastion.example.com
+  web1:
+    host: 10.0.0.11
+    tags: [nginx]
+  web2:
+    host: 10.0.0.12
+    user: admin
+    groups: [canary]
+  db1:
+    host: 10.0.0.21
+    port: 2222
+    key: /etc/keys/db
+    vars:
+      role: primary
+  local:
+    local: true
+groups:
+  web:
+    hosts: [web1, web2]
+    defaults:
+      port: 8022
+      vars:
+        role: frontend
+  canary:
+    defaults:
+      port: 9022
+  private:
+    children: [web]
+    hosts: [db1]
+    defaults:
+      jump: bastion
+      port: 7022
+`)
+
+	inventory, err := LoadInventory(inventoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Groups", func(t *testing.T) {
+		private, err := inventory.Group("private")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(private, []string{"db1", "web1", "web2"}) {
+			t.Fatalf("not expected: %v", private)
+		}
+		if all, _ := inventory.Group("all"); len(all) != 5 {
+			t.Fatalf("not expected: %v", all)
+		}
+		if tagged := inventory.Tagged("nginx"); !slices.Equal(tagged, []string{"web1"}) {
+			t.Fatalf("not expected: %v", tagged)
+		}
+		if _, err := inventory.Group("unknown"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		tests := []struct {
+			host string
+			user string
+			port int
+			key  string
+			jump string
+			role string
+		}{
+			{"bastion", "deploy", 0, filepath.Join(dir, "keys/deploy"), "", ""},
+			{"web1", "deploy", 8022, filepath.Join(dir, "keys/deploy"), "bastion", "frontend"},
+			{"web2", "admin", 9022, filepath.Join(dir, "keys/deploy"), "bastion", "frontend"},
+			{"db1", "deploy", 2222, "/etc/keys/db", "bastion", "primary"},
+		}
+		for _, test := range tests {
+			entry, err := inventory.Entry(test.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.User != test.user || entry.Port != test.port || entry.Key != test.key || entry.Jump != test.jump ||
+				entry.Vars["role"] != test.role || entry.Vars["env"] != "prod" {
+				t.Fatalf("not expected: %+v", entry)
+			}
+		}
+		if entry, _ := inventory.Entry("web2"); !slices.Equal(entry.Groups, []string{"canary", "private", "web"}) {
+			t.Fatalf("not expected: %v", entry.Groups)
+		}
+	})
+
+	t.Run("Machines", func(t *testing.T) {
+		local, err := inventory.Machine("local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local.Host() != "localhost" {
+			t.Fatalf("expected local machine")
+		}
+		if _, err := inventory.Machine("web1"); err == nil {
+			t.Fatal("expected error for the missing key")
+		}
+	})
+}
+
+func TestInventoryMachine(t *testing.T) {
+	bastion := newTestSshServer(t)
+	target := newTestSshServer(t)
+
+	dir := t.TempDir()
+	t.Setenv("SSH_AUTH_SOCK", "")
+	target.authorize(writeTestKey(t, filepath.Join(dir, "keys", "target")))
+
+	// the key of the jump host is encrypted
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, "keys", "bastion"), string(pem.EncodeToMemory(block)))
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bastion.authorize(signer.PublicKey())
+
+	inventoryPath := filepath.Join(dir, "inventory.json")
+	writeTestFile(t, inventoryPath, fmt.Sprintf(`{
+  "defaults": {"user": "test", "strict_host_key_checking": "no"},
+  "hosts": {
+    "bastion": {"host": "127.0.0.1", "port": %d, "key": "keys/bastion"},
+    "target": {"host": "127.0.0.1", "port": %d, "key": "keys/target", "jump": "bastion"}
+  }
+}`, bastion.port(), target.port()))
+
+	inventory, err := LoadInventory(inventoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inventory.GroupMachines("all"); err == nil {
+		t.Fatal("expected error for the encrypted key")
+	}
+	passphrase := func(string) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+	machines, err := inventory.GroupMachines("all", WithPassphrase(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, machine := range machines {
+		defer machine.Close()
+	}
+
+	expected := fmt.Sprintf("test@127.0.0.1 -p %d -J test@127.0.0.1:%d", target.port(), bastion.port())
+	if actual := machines[1].(fmt.Stringer).String(); actual != expected {
+		t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+	}
+	output, err := machines[1].ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "echo", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "hello\n" {
+		t.Fatalf("not expected: [%s]", output)
+	}
+	if bastion.connections.Load() != 1 || target.connections.Load() != 1 {
+		t.Fatalf("expected connection through the bastion")
+	}
+}
+
+func TestInventoryValidation(t *testing.T) {
+	tests := map[string]string{
+		"no hosts":       `groups: {}`,
+		"unknown field":  `hosts: {a: {address: x}}`,
+		"port":           `hosts: {a: {port: 70000}}`,
+		"unknown host":   `{hosts: {a: {}}, groups: {g: {hosts: [b]}}}`,
+		"unknown group":  `hosts: {a: {groups: [g]}}`,
+		"unknown child":  `{hosts: {a: {}}, groups: {g: {children: [h]}}}`,
+		"group cycle":    `{hosts: {a: {}}, groups: {g: {children: [h]}, h: {children: [g]}}}`,
+		"jump cycle":     `hosts: {a: {jump: b}, b: {jump: a}}`,
+		"reserved group": `{hosts: {a: {}}, groups: {all: {}}}`,
+		"host checking":  `hosts: {a: {strict_host_key_checking: maybe}}`,
+	}
+	for name, inventory := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseInventoryYaml([]byte(inventory), "")
+			if !errors.Is(err, ErrInvalidInventory) {
+				t.Fatalf("expected ErrInvalidInventory, got: %v", err)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package exec
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	stdio "io"
 	"os"
 	"os/exec"
+	"time"
 )
 
 func IsLocal(m Machine) bool {
@@ -17,6 +20,7 @@ func IsLocalHost(host string) bool {
 
 type localExecutionContext struct {
 	localUser string
+	env       Env
 }
 
 func (rc *localExecutionContext) String() string {
@@ -25,12 +29,45 @@ func (rc *localExecutionContext) String() string {
 
 // ExecuteCmd implements Machine
 func (rc *localExecutionContext) ExecuteCmd(io CommandInOut, dir, command string, arg ...string) (string, error) {
-	return localExec(io, dir, command, arg...)
+	return localExec(context.Background(), io, rc.commandSpec(dir, command, arg...))
 }
 
 // RunCmd implements Machine
 func (rc *localExecutionContext) RunCmd(io CommandInOut, dir, command string, arg ...string) error {
-	return localRun(io, dir, command, arg...)
+	return localRun(context.Background(), io, rc.commandSpec(dir, command, arg...))
+}
+
+// ExecuteCmdContext implements Machine
+func (rc *localExecutionContext) ExecuteCmdContext(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (string, error) {
+	return localExec(ctx, io, rc.commandSpec(dir, command, arg...))
+}
+
+// RunCmdContext implements Machine
+func (rc *localExecutionContext) RunCmdContext(ctx context.Context, io CommandInOut, dir, command string, arg ...string) error {
+	return localRun(ctx, io, rc.commandSpec(dir, command, arg...))
+}
+
+// RunCmdWithResult implements Machine
+func (rc *localExecutionContext) RunCmdWithResult(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (*CommandResult, error) {
+	return localRunWithResult(ctx, io, rc.commandSpec(dir, command, arg...))
+}
+
+// WithEnv implements Machine
+func (rc *localExecutionContext) WithEnv(env Env) Machine {
+	clone := *rc
+	clone.env = rc.env.merge(env)
+	return &clone
+}
+
+func (rc *localExecutionContext) commandSpec(dir, command string, arg ...string) *commandSpec {
+	spec := newCommandSpec(dir, command, arg...)
+	spec.env = rc.env
+	return spec
+}
+
+// Close implements Machine, there is nothing to release for the local machine.
+func (rc *localExecutionContext) Close() error {
+	return nil
 }
 
 // User implements Machine
@@ -60,53 +97,128 @@ func NewLocalMachine(user string) Machine {
 	return localMachine
 }
 
-func NewSshMachine(hostname string, port int, sshConfig *ssh.ClientConfig) Machine {
+func NewSshMachine(hostname string, port int, sshConfig *ssh.ClientConfig, options ...SshOption) Machine {
 	sshMachine := &sshExecutionContext{
 		host:      hostname,
 		port:      port,
 		sshConfig: sshConfig,
+		conn:      newSshConnection(joinHostPort(hostname, port), sshConfig),
+	}
+	for _, option := range options {
+		option(sshMachine)
 	}
 	return sshMachine
 }
 
-func localExec(io CommandInOut, dir, command string, arg ...string) (string, error) {
-	cmd := exec.Command(command, arg...)
-	cmd.Dir = dir
+// newLocalCommand creates a command bound to ctx. Cancellable commands are started
+// in their own process group so that the whole group is killed on cancellation.
+func newLocalCommand(ctx context.Context, command string, arg ...string) *exec.Cmd {
+	if ctx.Done() == nil {
+		return exec.Command(command, arg...)
+	}
+	cmd := exec.CommandContext(ctx, command, arg...)
+	setProcessGroupCancel(cmd)
+	cmd.WaitDelay = localWaitDelay
+	return cmd
+}
+
+func localExec(ctx context.Context, io CommandInOut, spec *commandSpec) (string, error) {
 	if io.In() != nil {
-		cmd.Stdin = io.In()
+		spec.stdin = io.In()
 	} else {
-		cmd.Stdin = os.Stdin
+		spec.stdin = os.Stdin
 	}
 
-	logCommand(io, "localhost", "", command, arg...)
+	var output singleWriter
+	spec.stdout = &output
+	spec.stderr = &output
 
-	output, err := cmd.CombinedOutput()
+	_, err := localStart(ctx, io, spec)
 	if err != nil {
 		return "", fmt.Errorf("%w: failed to run local command", err)
 	}
 
-	return string(output), nil
+	return output.String(), nil
+}
+
+func localRun(ctx context.Context, io CommandInOut, spec *commandSpec) error {
+	spec.stdout, spec.stderr = serializeWriters(io.Out(), io.Err())
+	spec.stdin = io.In()
+
+	_, err := localStart(ctx, io, spec)
+	if err != nil {
+		return fmt.Errorf("%w: failed to run local command", err)
+	}
+
+	return nil
 }
 
-func localRun(io CommandInOut, dir, command string, arg ...string) error {
-	cmd := exec.Command(command, arg...)
-	cmd.Dir = dir
-	if io.Out() != nil {
-		cmd.Stdout = io.Out()
+func localRunWithResult(ctx context.Context, io CommandInOut, spec *commandSpec) (*CommandResult, error) {
+	spec.stdin = io.In()
+
+	var capture resultCapture
+	capture.attach(spec, io)
+
+	result, err := localStart(ctx, io, spec)
+	capture.fill(result)
+	if err != nil {
+		return result, fmt.Errorf("%w: failed to run local command", err)
 	}
-	if io.Err() != nil {
-		cmd.Stderr = io.Err()
+
+	return result, nil
+}
+
+// localStart runs the command described by spec and waits for it to finish.
+// The result is nil when the command could not be started.
+func localStart(ctx context.Context, io CommandInOut, spec *commandSpec) (*CommandResult, error) {
+	if err := spec.env.validate(); err != nil {
+		return nil, err
 	}
-	if io.In() != nil {
-		cmd.Stdin = io.In()
+
+	cmd := newLocalCommand(ctx, spec.command, spec.args...)
+	cmd.Dir = spec.dir
+	if !spec.env.isEmpty() {
+		cmd.Env = spec.env.environ(os.Environ())
 	}
+	if spec.stdout != nil {
+		cmd.Stdout = spec.stdout
+	}
+	stderrTail := newTailWriter(stderrTailSize)
+	if spec.stderr != nil {
+		cmd.Stderr = stdio.MultiWriter(spec.stderr, stderrTail)
+	} else {
+		cmd.Stderr = stderrTail
+	}
+	if spec.stdin != nil {
+		cmd.Stdin = spec.stdin
+	}
+
+	logCommand(io, "localhost", "", spec.command, spec.args...)
 
-	logCommand(io, "localhost", "", command, arg...)
+	commandLine := buildCommandLine(spec.command, spec.args...)
+	result := &CommandResult{
+		Host:        "localhost",
+		CommandLine: commandLine,
+		ExitCode:    -1,
+		StartTime:   time.Now(),
+	}
 
 	err := cmd.Run()
+	if cmd.ProcessState == nil {
+		// the command has not been started
+		result = nil
+	} else {
+		result.EndTime = time.Now()
+		result.ExitCode = cmd.ProcessState.ExitCode()
+		result.Signal = exitSignal(cmd.ProcessState)
+	}
+
 	if err != nil {
-		return fmt.Errorf("%w: failed to run local command", err)
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			err = ctxErr
+		}
+		return result, localCommandError(result, cmd, commandLine, stderrTail, err)
 	}
 
-	return nil
+	return result, nil
 }
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package exec
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+const localWaitDelay = 2 * time.Second
+
+// setProcessGroupCancel is a no-op, exec.CommandContext kills the process itself.
+func setProcessGroupCancel(_ *exec.Cmd) {
+}
+
+func exitSignal(_ *os.ProcessState) string {
+	return ""
+}
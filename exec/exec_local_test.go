@@ -0,0 +1,122 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocalContext(t *testing.T) {
+	machine := NewLocalMachine("test")
+
+	t.Run("RunCmdContext timeout", func(t *testing.T) {
+		var buffer bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, nil, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := machine.RunCmdContext(ctx, io, "", "sleep", "10")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected ErrTimeout, got: %v", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("command was not killed in time: %s", elapsed)
+		}
+	})
+
+	t.Run("ExecuteCmdContext canceled", func(t *testing.T) {
+		io := NewCommandInOut(nil, nil, nil, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := machine.ExecuteCmdContext(ctx, io, "", "sh", "-c", "sleep 10 & wait")
+		if !errors.Is(err, ErrCanceled) {
+			t.Fatalf("expected ErrCanceled, got: %v", err)
+		}
+	})
+
+	t.Run("ExecuteCmdContext success", func(t *testing.T) {
+		io := NewCommandInOut(nil, nil, nil, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		output, err := machine.ExecuteCmdContext(ctx, io, "", "echo", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "hello\n" {
+			t.Fatalf("not expected: [%s]", output)
+		}
+	})
+}
+
+func TestLocalRunCmdWithResult(t *testing.T) {
+	machine := NewLocalMachine("test")
+
+	t.Run("Separated streams and exit code", func(t *testing.T) {
+		var out bytes.Buffer
+		io := NewCommandInOut(&out, nil, nil, nil)
+
+		result, err := machine.RunCmdWithResult(context.Background(), io, "", "sh", "-c", "echo out; echo err >&2; exit 3")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if result == nil {
+			t.Fatalf("expected result")
+		}
+		if string(result.Stdout) != "out\n" {
+			t.Fatalf("not expected stdout: [%s]", result.Stdout)
+		}
+		if string(result.Stderr) != "err\n" {
+			t.Fatalf("not expected stderr: [%s]", result.Stderr)
+		}
+		if result.ExitCode != 3 {
+			t.Fatalf("not expected exit code: %d", result.ExitCode)
+		}
+		if result.Host != "localhost" {
+			t.Fatalf("not expected host: [%s]", result.Host)
+		}
+		if result.Duration() < 0 || result.StartTime.IsZero() {
+			t.Fatalf("not expected timing: %s - %s", result.StartTime, result.EndTime)
+		}
+		if out.String() != "out\n" {
+			t.Fatalf("stdout not copied to io.Out(): [%s]", out.String())
+		}
+	})
+
+	t.Run("Signal", func(t *testing.T) {
+		io := NewCommandInOut(nil, nil, nil, nil)
+
+		result, err := machine.RunCmdWithResult(context.Background(), io, "", "sh", "-c", "kill -TERM $$")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if result.Signal != "TERM" || result.ExitCode != -1 {
+			t.Fatalf("not expected status: %d %s", result.ExitCode, result.Signal)
+		}
+	})
+
+	t.Run("Not started", func(t *testing.T) {
+		io := NewCommandInOut(nil, nil, nil, nil)
+
+		result, err := machine.RunCmdWithResult(context.Background(), io, "", "/nonexistent/command")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if result != nil {
+			t.Fatalf("expected no result, got: %+v", result)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	prefixedOutMarker = "|"
+	prefixedErrMarker = "!"
+	// maxPrefixedLine is the length of a line without newline written before its end.
+	maxPrefixedLine = 64 * 1024
+
+	ansiReset = "\x1b[0m"
+	ansiRed   = "\x1b[31m"
+)
+
+// prefixColors are the ANSI colors given to the hosts in turn.
+var prefixColors = []string{"\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m", "\x1b[92m", "\x1b[93m", "\x1b[94m", "\x1b[95m", "\x1b[96m"}
+
+// PrefixOptions configures the prefix of the lines written by PrefixedInOut.
+type PrefixOptions struct {
+	// Color gives every host its own ANSI color and shows the marker of standard error in red.
+	Color bool
+	// Timestamp starts every line with the time it was completed.
+	Timestamp bool
+	// TimeFormat is the layout of the timestamp, by default 15:04:05.000.
+	TimeFormat string
+}
+
+// PrefixedInOut shares writers among the commands of many machines running concurrently. The output of
+// every host is buffered by line, and every line is written whole, prefixed with the host:
+//
+//	web1 | standard output
+//	web1 ! standard error
+//
+// The hosts are padded to the same width, see Register. Lines of the log are not prefixed as they contain
+// the host already. Fleet and Rolling register all machines and give each its own HostInOut, otherwise use ForHost.
+type PrefixedInOut struct {
+	out     io.Writer
+	err     io.Writer
+	log     io.Writer
+	options PrefixOptions
+
+	mutex  sync.Mutex
+	width  int
+	colors map[string]string
+	now    func() time.Time
+}
+
+// NewPrefixedInOut creates a PrefixedInOut writing to out, err and log, which can be the same writer.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewPrefixedInOut(out, err, log io.Writer, options PrefixOptions) *PrefixedInOut {
+	if options.TimeFormat == "" {
+		options.TimeFormat = "15:04:05.000"
+	}
+	return &PrefixedInOut{
+		out:     out,
+		err:     err,
+		log:     log,
+		options: options,
+		colors:  make(map[string]string),
+		now:     time.Now,
+	}
+}
+
+// Out implements CommandInOut, writes are serialized with the lines of the hosts.
+func (p *PrefixedInOut) Out() io.Writer {
+	return p.shared(p.out)
+}
+
+// Err implements CommandInOut, writes are serialized with the lines of the hosts.
+func (p *PrefixedInOut) Err() io.Writer {
+	return p.shared(p.err)
+}
+
+// Log implements CommandInOut, writes are serialized with the lines of the hosts.
+func (p *PrefixedInOut) Log() io.Writer {
+	return p.shared(p.log)
+}
+
+// In implements CommandInOut, there is no input shared by many machines.
+func (p *PrefixedInOut) In() io.Reader {
+	return nil
+}
+
+func (p *PrefixedInOut) shared(w io.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &sharedWriter{w: w, mu: &p.mutex}
+}
+
+// Register pads the prefix to the width of the hosts and gives them their colors. The width only
+// grows, so register all hosts before their first line is written to keep the lines aligned.
+func (p *PrefixedInOut) Register(hosts ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, host := range hosts {
+		p.width = max(p.width, len(host))
+		if _, ok := p.colors[host]; !ok {
+			p.colors[host] = prefixColors[len(p.colors)%len(prefixColors)]
+		}
+	}
+}
+
+// ForHost registers the host and returns its CommandInOut, it must be flushed once the command has finished.
+func (p *PrefixedInOut) ForHost(host string) *HostInOut {
+	p.Register(host)
+
+	h := &HostInOut{parent: p, host: host}
+	if p.out != nil {
+		h.out = &prefixedWriter{parent: p, host: host, w: p.out, marker: prefixedOutMarker}
+	}
+	if p.err != nil {
+		h.err = &prefixedWriter{parent: p, host: host, w: p.err, marker: prefixedErrMarker}
+	}
+	return h
+}
+
+// prefix returns the prefix of a line of host, must be called with the mutex held.
+func (p *PrefixedInOut) prefix(host, marker string) string {
+	var prefix string
+	if p.options.Timestamp {
+		prefix = p.now().Format(p.options.TimeFormat) + " "
+	}
+	if p.options.Color {
+		if marker == prefixedErrMarker {
+			marker = ansiRed + marker + ansiReset
+		}
+		return fmt.Sprintf("%s%s%-*s%s %s ", prefix, p.colors[host], p.width, host, ansiReset, marker)
+	}
+	return fmt.Sprintf("%s%-*s %s ", prefix, p.width, host, marker)
+}
+
+// HostInOut is the CommandInOut of one host of a PrefixedInOut.
+type HostInOut struct {
+	parent *PrefixedInOut
+	host   string
+	out    *prefixedWriter
+	err    *prefixedWriter
+}
+
+// Out implements CommandInOut
+func (h *HostInOut) Out() io.Writer {
+	if h.out == nil {
+		return nil
+	}
+	return h.out
+}
+
+// Err implements CommandInOut
+func (h *HostInOut) Err() io.Writer {
+	if h.err == nil {
+		return nil
+	}
+	return h.err
+}
+
+// Log implements CommandInOut
+func (h *HostInOut) Log() io.Writer {
+	return h.parent.Log()
+}
+
+// In implements CommandInOut
+func (h *HostInOut) In() io.Reader {
+	return nil
+}
+
+// Flush writes the last lines not ended by a newline.
+func (h *HostInOut) Flush() error {
+	var errs []error
+	for _, w := range []*prefixedWriter{h.out, h.err} {
+		if w != nil {
+			errs = append(errs, w.flush())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prefixedWriter writes whole lines prefixed with the host.
+type prefixedWriter struct {
+	parent *PrefixedInOut
+	host   string
+	w      io.Writer
+	marker string
+
+	mutex   sync.Mutex
+	partial []byte
+}
+
+func (w *prefixedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.partial = append(w.partial, p...)
+	end := bytes.LastIndexByte(w.partial, '\n') + 1
+	if end == 0 && len(w.partial) >= maxPrefixedLine {
+		end = len(w.partial)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+	lines := w.partial[:end]
+	err := w.writeLines(lines)
+	w.partial = append(w.partial[:0], w.partial[end:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *prefixedWriter) flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.partial) == 0 {
+		return nil
+	}
+	err := w.writeLines(w.partial)
+	w.partial = w.partial[:0]
+	return err
+}
+
+// writeLines writes the lines with one call to the shared writer, a newline is added to the last one if missing.
+func (w *prefixedWriter) writeLines(lines []byte) error {
+	w.parent.mutex.Lock()
+	defer w.parent.mutex.Unlock()
+
+	prefix := w.parent.prefix(w.host, w.marker)
+	var buffer bytes.Buffer
+	for len(lines) > 0 {
+		line, rest, found := bytes.Cut(lines, []byte{'\n'})
+		buffer.WriteString(prefix)
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+		if !found {
+			break
+		}
+		lines = rest
+	}
+	_, err := w.w.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,107 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefixedInOut(t *testing.T) {
+	t.Run("Lines", func(t *testing.T) {
+		out := &singleWriter{}
+		prefixed := NewPrefixedInOut(out, out, nil, PrefixOptions{})
+		web := prefixed.ForHost("web")
+		db := prefixed.ForHost("db-primary")
+
+		fmt.Fprint(web.Out(), "hel")
+		fmt.Fprint(db.Err(), "error\nwar")
+		fmt.Fprint(web.Out(), "lo\nworld\n")
+		fmt.Fprint(db.Err(), "ning")
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := web.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "db-primary ! error\n" +
+			"web        | hello\n" +
+			"web        | world\n" +
+			"db-primary ! warning\n"
+		if actual := out.String(); actual != expected {
+			t.Fatalf("not expected: [%s]", actual)
+		}
+	})
+
+	t.Run("Color and timestamp", func(t *testing.T) {
+		out := &singleWriter{}
+		errOut := &singleWriter{}
+		prefixed := NewPrefixedInOut(out, errOut, nil, PrefixOptions{Color: true, Timestamp: true, TimeFormat: time.Kitchen})
+		prefixed.now = func() time.Time {
+			return time.Date(2024, 1, 1, 15, 4, 0, 0, time.UTC)
+		}
+		host := prefixed.ForHost("a")
+
+		fmt.Fprintln(host.Out(), "out")
+		fmt.Fprintln(host.Err(), "err")
+		if actual := out.String(); actual != "3:04PM "+prefixColors[0]+"a"+ansiReset+" | out\n" {
+			t.Fatalf("not expected: %q", actual)
+		}
+		if actual := errOut.String(); actual != "3:04PM "+prefixColors[0]+"a"+ansiReset+" "+ansiRed+"!"+ansiReset+" err\n" {
+			t.Fatalf("not expected: %q", actual)
+		}
+		if prefixed.ForHost("b"); prefixed.colors["b"] == prefixed.colors["a"] {
+			t.Fatalf("expected another color")
+		}
+	})
+
+	t.Run("Fleet", func(t *testing.T) {
+		out := &singleWriter{}
+		log := &singleWriter{}
+		fleet := NewFleet(newFleetTestMachines("a", "b!", "c")...)
+
+		_, _ = fleet.RunCmd(context.Background(), NewPrefixedInOut(out, out, log, PrefixOptions{}), "",
+			"sh", "-c", "printf 'one\\n'; sleep 0.1; printf 'two'")
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		expected := []string{"a | one", "a | two", "b ! failed b", "c | one", "c | two"}
+		if len(lines) != len(expected) {
+			t.Fatalf("not expected: [%s]", out.String())
+		}
+		for _, line := range expected {
+			if !strings.Contains(out.String(), line+"\n") {
+				t.Fatalf("missing %q: [%s]", line, out.String())
+			}
+		}
+		if strings.Count(log.String(), "\n") != 3 {
+			t.Fatalf("not expected: [%s]", log.String())
+		}
+	})
+
+	t.Run("Aligned one host at a time", func(t *testing.T) {
+		out := &singleWriter{}
+		fleet := NewFleet(newFleetTestMachines("a", "very-long-host")...)
+		fleet.Concurrency = 1
+
+		_, _ = fleet.RunCmd(context.Background(), NewPrefixedInOut(out, out, nil, PrefixOptions{}), "", "echo", "x")
+
+		expected := "a              | x\nvery-long-host | x\n"
+		if out.String() != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, out.String())
+		}
+	})
+
+	t.Run("Aligned across rolling batches", func(t *testing.T) {
+		out := &singleWriter{}
+		rolling := NewRolling(BatchOf(1), newFleetTestMachines("a", "very-long-host")...)
+
+		_, _ = rolling.RunCmd(context.Background(), NewPrefixedInOut(out, out, nil, PrefixOptions{}), "", "echo", "x")
+
+		expected := "a              | x\nvery-long-host | x\n"
+		if out.String() != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, out.String())
+		}
+	})
+}
@@ -1,23 +1,115 @@
 package exec
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-func buildRsyncCmdAndArgs(sourceRootDir string, sourceRelativeDir string, to Machine, destinationRootDir string, options []string) (string, []string) {
+// buildRsyncCmdAndArgs returns the machine executing rsync together with the command. Like Scp,
+// rsync runs on the destination when it is local and on the source otherwise.
+func buildRsyncCmdAndArgs(from Machine, sourceRootDir string, sourceRelativeDir string, to Machine, destinationRootDir string, options []string) (Machine, string, []string) {
 	cmd := "rsync"
-	args := buildRsyncArgs(sourceRootDir, sourceRelativeDir, to, destinationRootDir, options)
-	return cmd, args
+	execMachine := from
+	if IsLocal(to) {
+		execMachine = to
+	}
+	args := buildRsyncArgs(execMachine, from, sourceRootDir, sourceRelativeDir, to, destinationRootDir, options)
+	return execMachine, cmd, args
 }
 
-func buildRsyncArgs(sourceRootDir string, sourceRelativeDir string, to Machine, destinationRootDir string, options []string) []string {
+func buildRsyncArgs(execMachine Machine, from Machine, sourceRootDir string, sourceRelativeDir string, to Machine, destinationRootDir string, options []string) []string {
 	// must append "/./" in order to copy relative paths, see man for "rsync -R"
 	source := fmt.Sprintf("%s/./%s", sourceRootDir, sourceRelativeDir)
-	destination := fmt.Sprintf("%s@%s:%s", to.User(), to.IpAddr(), destinationRootDir)
-	return append(options, source, destination)
+	destination := destinationRootDir
+	args := append([]string{}, options...)
+
+	// at most one side is remote to the executing machine
+	var sshArgs []string
+	if !isSameMachine(from, execMachine) {
+		source = remoteLocation(from, source)
+		sshArgs = sshCommandArgs(from, "-p")
+	}
+	if !isSameMachine(to, execMachine) {
+		destination = remoteLocation(to, destination)
+		sshArgs = sshCommandArgs(to, "-p")
+	}
+	if len(sshArgs) > 0 && !appendRemoteShellArgs(args, sshArgs) {
+		args = append(args, "-e", buildCommandLine("ssh", sshArgs...))
+	}
+	return append(args, source, destination)
+}
+
+// appendRemoteShellArgs appends sshArgs to the remote shell set with -e or --rsh in args, the last
+// one as used by rsync. It returns false when args do not set a remote shell.
+func appendRemoteShellArgs(args []string, sshArgs []string) bool {
+	words := make([]string, len(sshArgs))
+	for i, arg := range sshArgs {
+		words[i] = shellQuote(arg)
+	}
+	quoted := strings.Join(words, " ")
+	for i := len(args) - 1; i >= 0; i-- {
+		switch arg := args[i]; {
+		case (arg == "-e" || arg == "--rsh") && i+1 < len(args):
+			args[i+1] += " " + quoted
+			return true
+		case strings.HasPrefix(arg, "--rsh="), strings.HasPrefix(arg, "-e") && len(arg) > 2 && arg[2] != '-':
+			args[i] += " " + quoted
+			return true
+		}
+	}
+	return false
+}
+
+// isSameMachine reports whether both machines are the same account on the same host, machines
+// on one host with different ports or users, e.g. containers, are different. Local machines are
+// the same whatever their user.
+func isSameMachine(m Machine, other Machine) bool {
+	_, local := m.(*localExecutionContext)
+	_, otherLocal := other.(*localExecutionContext)
+	if local || otherLocal {
+		return local && otherLocal
+	}
+	return m.Host() == other.Host() && m.Port() == other.Port() && m.User() == other.User()
+}
+
+// hosts returns the hosts of the machines.
+func hosts(machines []Machine) []string {
+	hosts := make([]string, len(machines))
+	for i, m := range machines {
+		hosts[i] = m.Host()
+	}
+	return hosts
+}
+
+// remoteLocation formats a path on a remote machine for scp and rsync.
+func remoteLocation(m Machine, path string) string {
+	return fmt.Sprintf("%s@%s:%s", m.User(), bracketIPv6(m.IpAddr()), path)
+}
+
+// bracketIPv6 encloses IPv6 addresses in brackets, as required in user@host:path locations.
+func bracketIPv6(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// sshCommandArgs returns the options of the ssh client connecting to m, portFlag is
+// "-p" for ssh and rsync and "-P" for scp.
+func sshCommandArgs(m Machine, portFlag string) []string {
+	var args []string
+	if port := m.Port(); port != 0 && port != 22 {
+		args = append(args, portFlag, strconv.Itoa(port))
+	}
+	if provider, ok := m.(sshCommandOptionsProvider); ok {
+		args = append(args, provider.sshCommandOptions().args()...)
+	}
+	return args
 }
 
 func joinHostPort(host string, port int) string {
@@ -40,3 +132,52 @@ func logCommand(io CommandInOut, host string, flag string, command string, args
 	}
 
 }
+
+// singleWriter is a buffer that can be shared as stdout and stderr of one command.
+type singleWriter struct {
+	b  bytes.Buffer
+	mu sync.Mutex
+}
+
+func (w *singleWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.b.Write(p)
+}
+
+func (w *singleWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.b.String()
+}
+
+// lockedWriter serializes writes of stdout and stderr copied to the same writer.
+type lockedWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// serializeWriters returns writers safe to be written concurrently when out and err are the same writer.
+func serializeWriters(out, err io.Writer) (io.Writer, io.Writer) {
+	if out == nil || !interfaceEqual(out, err) {
+		return out, err
+	}
+	w := &lockedWriter{w: out}
+	return w, w
+}
+
+// interfaceEqual protects against panics from comparing non-comparable dynamic types.
+func interfaceEqual(a, b any) (equal bool) {
+	defer func() {
+		if recover() != nil {
+			equal = false
+		}
+	}()
+	return a == b
+}
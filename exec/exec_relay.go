@@ -0,0 +1,261 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRelayBufferSize       = 4 * 1024 * 1024
+	defaultRelayProgressInterval = time.Second
+	relayChunkSize               = 32 * 1024
+)
+
+// RelayOptions configures Relay.
+type RelayOptions struct {
+	// BufferSize is how many bytes read from the source may wait for the destination, 4 MiB by default.
+	BufferSize int
+	// Progress is called every ProgressInterval and once more when the relay has finished.
+	Progress func(stats RelayStats)
+	// ProgressInterval defaults to one second.
+	ProgressInterval time.Duration
+}
+
+// RelayStats describes the data relayed from the source to the destination machine.
+type RelayStats struct {
+	Bytes    int64
+	Duration time.Duration
+}
+
+// BytesPerSecond returns the average throughput.
+func (s RelayStats) BytesPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// Relay copies a file or directory from the source to the destination machine by streaming
+// it through the local process: cat for files, a tar stream for directories. Neither machine
+// needs to reach or authenticate to the other one and any Machine implementation can be used.
+// A directory is extracted into destinationPath. A file is written to a temporary file next to
+// destinationPath and moved into place once both sides have succeeded, an existing file is kept
+// when the relay fails.
+func Relay(ctx context.Context, io CommandInOut, sourceMachine Machine, sourcePath string, destinationMachine Machine, destinationPath string, options RelayOptions) (RelayStats, error) {
+	isDir, err := DirectoryExistsContext(ctx, sourceMachine, io, sourcePath)
+	if err != nil {
+		return RelayStats{}, err
+	}
+
+	var sourceCmd, destinationCmd []string
+	var temporaryPath string
+	if isDir {
+		if err := MkdirsContext(ctx, destinationMachine, io, destinationPath); err != nil {
+			return RelayStats{}, err
+		}
+		sourceCmd = []string{"tar", "-C", sourcePath, "-cf", "-", "."}
+		destinationCmd = []string{"tar", "-C", destinationPath, "-xf", "-"}
+	} else {
+		exists, err := FileExistsContext(ctx, sourceMachine, io, sourcePath)
+		if err != nil {
+			return RelayStats{}, err
+		}
+		if !exists {
+			return RelayStats{}, fmt.Errorf("%w: %s on %s", fs.ErrNotExist, sourcePath, sourceMachine.Host())
+		}
+		temporaryPath = fmt.Sprintf("%s.relay-%d", destinationPath, time.Now().UnixNano())
+		sourceCmd = []string{"cat", sourcePath}
+		destinationCmd = []string{"sh", "-c", `cat > "$1"`, "sh", temporaryPath}
+	}
+
+	logCommand(io, "localhost", "", "relay", transferLocation(sourceMachine, sourcePath), transferLocation(destinationMachine, destinationPath))
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pipe := newBufferedPipe(options.bufferSize())
+	start := time.Now()
+	stats := func() RelayStats {
+		return RelayStats{Bytes: pipe.transferred.Load(), Duration: time.Since(start)}
+	}
+
+	stopProgress := startRelayProgress(options, stats)
+
+	var wg sync.WaitGroup
+	var sourceErr, destinationErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sourceIo := NewCommandInOut(pipe, io.Err(), io.Log(), nil)
+		sourceErr = sourceMachine.RunCmdContext(ctx, sourceIo, "", sourceCmd[0], sourceCmd[1:]...)
+		pipe.closeWrite(sourceErr)
+		if sourceErr != nil {
+			cancel()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		destinationIo := NewCommandInOut(io.Out(), io.Err(), io.Log(), pipe)
+		destinationErr = destinationMachine.RunCmdContext(ctx, destinationIo, "", destinationCmd[0], destinationCmd[1:]...)
+		pipe.closeRead()
+		if destinationErr != nil {
+			cancel()
+		}
+	}()
+	wg.Wait()
+
+	stopProgress()
+	result := stats()
+	if options.Progress != nil {
+		options.Progress(result)
+	}
+
+	if temporaryPath != "" {
+		if sourceErr == nil && destinationErr == nil {
+			destinationErr = destinationMachine.RunCmdContext(parent, io, "", "mv", "-f", temporaryPath, destinationPath)
+		}
+		if sourceErr != nil || destinationErr != nil {
+			// removed even when ctx is done
+			_ = destinationMachine.RunCmdContext(context.WithoutCancel(parent), io, "", "rm", "-f", temporaryPath)
+		}
+	}
+
+	if sourceErr != nil {
+		return result, fmt.Errorf("%w: failed to read %s from %s", sourceErr, sourcePath, sourceMachine.Host())
+	}
+	if destinationErr != nil {
+		return result, fmt.Errorf("%w: failed to write %s to %s", destinationErr, destinationPath, destinationMachine.Host())
+	}
+	return result, nil
+}
+
+func (o RelayOptions) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return defaultRelayBufferSize
+	}
+	return o.BufferSize
+}
+
+// startRelayProgress calls the progress callback periodically until the returned function is called.
+func startRelayProgress(options RelayOptions, stats func() RelayStats) func() {
+	if options.Progress == nil {
+		return func() {}
+	}
+	interval := options.ProgressInterval
+	if interval <= 0 {
+		interval = defaultRelayProgressInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				options.Progress(stats())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// bufferedPipe is an in-memory pipe holding up to a fixed number of bytes, so that the
+// writer can run ahead of the reader. Unlike io.Pipe, writes after the writer side has
+// been closed fail instead of panicking, a command may still flush output after it was killed.
+type bufferedPipe struct {
+	chunks      chan []byte
+	current     []byte
+	transferred atomic.Int64
+
+	readDone      chan struct{}
+	readOnce      sync.Once
+	writeDone     chan struct{}
+	writeOnce     sync.Once
+	writeErr      error
+	writeErrMutex sync.Mutex
+}
+
+func newBufferedPipe(size int) *bufferedPipe {
+	return &bufferedPipe{
+		chunks:    make(chan []byte, max(1, size/relayChunkSize)),
+		readDone:  make(chan struct{}),
+		writeDone: make(chan struct{}),
+	}
+}
+
+func (p *bufferedPipe) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		size := min(len(b), relayChunkSize)
+		chunk := append([]byte(nil), b[:size]...)
+		select {
+		case p.chunks <- chunk:
+		case <-p.readDone:
+			return written, io.ErrClosedPipe
+		case <-p.writeDone:
+			return written, io.ErrClosedPipe
+		}
+		written += size
+		b = b[size:]
+	}
+	return written, nil
+}
+
+func (p *bufferedPipe) Read(b []byte) (int, error) {
+	if len(p.current) == 0 {
+		select {
+		case p.current = <-p.chunks:
+		case <-p.writeDone:
+			// drain what has been written before the writer side was closed
+			select {
+			case p.current = <-p.chunks:
+			default:
+				return 0, p.closeError()
+			}
+		}
+	}
+	n := copy(b, p.current)
+	p.current = p.current[n:]
+	p.transferred.Add(int64(n))
+	return n, nil
+}
+
+// closeWrite makes the reader return err, or io.EOF when err is nil, once the buffer is drained.
+func (p *bufferedPipe) closeWrite(err error) {
+	p.writeOnce.Do(func() {
+		p.writeErrMutex.Lock()
+		p.writeErr = err
+		p.writeErrMutex.Unlock()
+		close(p.writeDone)
+	})
+}
+
+// closeRead makes pending and future writes fail.
+func (p *bufferedPipe) closeRead() {
+	p.readOnce.Do(func() {
+		close(p.readDone)
+	})
+}
+
+func (p *bufferedPipe) closeError() error {
+	p.writeErrMutex.Lock()
+	defer p.writeErrMutex.Unlock()
+	if p.writeErr != nil {
+		return p.writeErr
+	}
+	return io.EOF
+}
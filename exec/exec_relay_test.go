@@ -0,0 +1,100 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelay(t *testing.T) {
+	server := newTestSshServer(t)
+	source := server.machine()
+	destination := server.machine()
+	ctx := context.Background()
+
+	tree := filepath.Join(t.TempDir(), "tree")
+	writeTestTree(t, tree)
+
+	t.Run("Relay file", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "file with space.txt")
+		var reported []RelayStats
+		options := RelayOptions{
+			BufferSize: 1,
+			Progress: func(stats RelayStats) {
+				reported = append(reported, stats)
+			},
+		}
+
+		stats, err := Relay(ctx, NewCommandInOut(nil, nil, nil, nil), source, filepath.Join(tree, "sub/sub/c.txt"), destination, target, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, _ := os.ReadFile(filepath.Join(tree, "sub/sub/c.txt"))
+		actual, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("content differs")
+		}
+		if stats.Bytes != int64(len(expected)) {
+			t.Fatalf("not expected bytes: %d", stats.Bytes)
+		}
+		if len(reported) == 0 || reported[len(reported)-1] != stats {
+			t.Fatalf("final progress not reported: %v", reported)
+		}
+	})
+
+	t.Run("Relay directory", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "relayed")
+		if _, err := Relay(ctx, NewCommandInOut(nil, nil, nil, nil), source, tree, NewLocalMachine("test"), target, RelayOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		assertSameTree(t, tree, target)
+	})
+
+	t.Run("Relay missing source", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "existing")
+		if err := os.WriteFile(target, []byte("kept"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Relay(ctx, NewCommandInOut(nil, nil, nil, nil), source, filepath.Join(tree, "missing"), destination, target, RelayOptions{})
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected fs.ErrNotExist, got: %v", err)
+		}
+		assertRelayKept(t, dir, target)
+	})
+
+	t.Run("Relay failing source", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "existing")
+		if err := os.WriteFile(target, []byte("kept"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// the source exists but cannot be read
+		_, err := Relay(ctx, NewCommandInOut(nil, nil, nil, nil), source, "/proc/self/mem", destination, target, RelayOptions{})
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		assertRelayKept(t, dir, target)
+	})
+}
+
+// assertRelayKept checks that the existing file is unchanged and no temporary file is left.
+func assertRelayKept(t *testing.T, dir, target string) {
+	t.Helper()
+	content, err := os.ReadFile(target)
+	if err != nil || string(content) != "kept" {
+		t.Fatalf("destination changed: [%s] %v", content, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("temporary file left: %v %v", entries, err)
+	}
+}
@@ -1,9 +1,15 @@
 package exec
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	stdio "io"
+	"net"
 	"strings"
+	"time"
 )
 
 type sshExecutionContext struct {
@@ -11,25 +17,210 @@ type sshExecutionContext struct {
 	ipAddr    string
 	port      int
 	sshConfig *ssh.ClientConfig
+	conn      *sshConnection
+	env       Env
+	sshOpts   SshCommandOptions
+	// passphrase is only used to create the configuration of the machine, see WithPassphrase
+	passphrase PassphraseFunc
+}
+
+// SshOption configures a machine created by NewSshMachine.
+type SshOption func(rc *sshExecutionContext)
+
+// WithKeepAlive sets the interval of keepalive requests on the shared connection, zero disables them.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithKeepAlive(interval time.Duration) SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.conn.keepAlive = interval
+	}
+}
+
+// WithIdleTimeout sets how long an unused connection is kept open, zero keeps it open until Close.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithIdleTimeout(timeout time.Duration) SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.conn.idleTimeout = timeout
+	}
+}
+
+// WithPassphrase decrypts the encrypted identity files of machines created from a configuration
+// file, e.g. by NewSshMachineFromConfig. It has no effect on NewSshMachine.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithPassphrase(passphrase PassphraseFunc) SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.passphrase = passphrase
+	}
+}
+
+// passphraseOption returns the PassphraseFunc of the options, which only set fields of the machine.
+func passphraseOption(options []SshOption) PassphraseFunc {
+	probe := &sshExecutionContext{conn: &sshConnection{}}
+	for _, option := range options {
+		option(probe)
+	}
+	return probe.passphrase
+}
+
+// JumpHost is an intermediate SSH server the connection to a machine is tunneled through,
+// like OpenSSH ProxyJump.
+type JumpHost struct {
+	Host      string
+	Port      int
+	SshConfig *ssh.ClientConfig
+}
+
+func (j JumpHost) address() string {
+	return joinHostPort(j.Host, j.Port)
+}
+
+func (j JumpHost) String() string {
+	return fmt.Sprintf("%s@%s", j.SshConfig.User, j.address())
+}
+
+// WithJumpHosts connects to the machine through the jump hosts, in the given order. The tunneled
+// connections are shared by all sessions of the machine and closed together with it.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithJumpHosts(jumpHosts ...JumpHost) SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.conn.jumpHosts = jumpHosts
+	}
+}
+
+// WithAgentForwarding forwards the local ssh-agent listening on SSH_AUTH_SOCK to the commands
+// run on the machine, like ssh -A. Commands such as git or scp run there can authenticate with
+// the local keys, which are never copied. Only enable it for trusted machines: their root user
+// can use the agent while a command runs.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithAgentForwarding() SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.conn.forwardAgent = true
+	}
+}
+
+// WithForwardedAgent is WithAgentForwarding with the given agent, e.g. an agent.NewKeyring()
+// holding keys that are not in the local ssh-agent.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithForwardedAgent(forwarded agent.Agent) SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.conn.forwardAgent = true
+		rc.conn.agent = forwarded
+	}
+}
+
+// SshCommandOptions are passed to the ssh client of scp and rsync commands connecting to
+// the machine, in addition to its port. The paths are resolved on the machine running the command.
+// They are not derived from the ssh.ClientConfig of the machine, e.g. its keys, and must be set
+// with WithSshCommandOptions. Scp copies over SFTP between SSH machines, so they only apply to
+// rsync and to scp run for other Machine implementations.
+type SshCommandOptions struct {
+	// IdentityFile is the private key file, the same key should be used in the ssh.ClientConfig.
+	IdentityFile string
+	// KnownHostsFile replaces the default known_hosts files.
+	KnownHostsFile string
+	// StrictHostKeyChecking is "yes", "no" or "accept-new", empty keeps the ssh default.
+	StrictHostKeyChecking string
+	// ProxyJump is a comma separated list of user@host:port jump hosts, it defaults
+	// to the jump hosts of the machine.
+	ProxyJump string
+}
+
+func (o SshCommandOptions) args() []string {
+	var args []string
+	if o.IdentityFile != "" {
+		args = append(args, "-i", o.IdentityFile)
+	}
+	if o.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+o.KnownHostsFile)
+	}
+	if o.StrictHostKeyChecking != "" {
+		args = append(args, "-o", "StrictHostKeyChecking="+o.StrictHostKeyChecking)
+	}
+	if o.ProxyJump != "" {
+		args = append(args, "-o", "ProxyJump="+o.ProxyJump)
+	}
+	return args
+}
+
+// sshCommandOptionsProvider is implemented by machines with options for external ssh clients.
+type sshCommandOptionsProvider interface {
+	sshCommandOptions() SshCommandOptions
+}
+
+// WithSshCommandOptions sets the options used by scp and rsync to connect to the machine.
+//
+//goland:noinspection GoUnusedExportedFunction
+func WithSshCommandOptions(options SshCommandOptions) SshOption {
+	return func(rc *sshExecutionContext) {
+		rc.sshOpts = options
+	}
+}
+
+func (rc *sshExecutionContext) sshCommandOptions() SshCommandOptions {
+	opts := rc.sshOpts
+	if opts.ProxyJump == "" {
+		opts.ProxyJump = rc.conn.proxyJump()
+	}
+	return opts
 }
 
 func (rc *sshExecutionContext) String() string {
-	return fmt.Sprintf("%s@%s -p %d", rc.sshConfig.User, rc.host, rc.port)
+	s := fmt.Sprintf("%s@%s -p %d", rc.sshConfig.User, rc.host, rc.port)
+	if proxyJump := rc.conn.proxyJump(); proxyJump != "" {
+		s += " -J " + proxyJump
+	}
+	return s
 }
 
 // ExecuteCmd implements Machine
 func (rc *sshExecutionContext) ExecuteCmd(io CommandInOut, dir, command string, arg ...string) (string, error) {
+	return rc.ExecuteCmdContext(context.Background(), io, dir, command, arg...)
+}
+
+// RunCmd implements Machine
+func (rc *sshExecutionContext) RunCmd(io CommandInOut, dir, command string, arg ...string) error {
+	return rc.RunCmdContext(context.Background(), io, dir, command, arg...)
+}
+
+// ExecuteCmdContext implements Machine
+func (rc *sshExecutionContext) ExecuteCmdContext(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (string, error) {
 	if rc.host == "" {
 		return "", fmt.Errorf("cannot execute ssh command, the remote hostname is not set")
 	}
-	serverAddress := joinHostPort(rc.host, rc.port)
-	return remoteExec(io, serverAddress, rc.sshConfig, dir, command, arg...)
+	return remoteExec(ctx, io, rc.conn, rc.commandSpec(dir, command, arg...))
 }
 
-// RunCmd implements Machine
-func (rc *sshExecutionContext) RunCmd(io CommandInOut, dir, command string, arg ...string) error {
-	serverAddress := joinHostPort(rc.host, rc.port)
-	return remoteRun(serverAddress, rc.sshConfig, io, dir, command, arg...)
+// RunCmdContext implements Machine
+func (rc *sshExecutionContext) RunCmdContext(ctx context.Context, io CommandInOut, dir, command string, arg ...string) error {
+	return remoteRun(ctx, rc.conn, io, rc.commandSpec(dir, command, arg...))
+}
+
+// RunCmdWithResult implements Machine
+func (rc *sshExecutionContext) RunCmdWithResult(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (*CommandResult, error) {
+	return remoteRunWithResult(ctx, rc.conn, io, rc.commandSpec(dir, command, arg...))
+}
+
+// WithEnv implements Machine, the returned machine shares the SSH connection.
+func (rc *sshExecutionContext) WithEnv(env Env) Machine {
+	clone := *rc
+	clone.env = rc.env.merge(env)
+	return &clone
+}
+
+func (rc *sshExecutionContext) commandSpec(dir, command string, arg ...string) *commandSpec {
+	spec := newCommandSpec(dir, command, arg...)
+	spec.env = rc.env
+	return spec
+}
+
+// Close implements Machine, it closes the shared SSH connection.
+func (rc *sshExecutionContext) Close() error {
+	return rc.conn.Close()
 }
 
 // User implements Machine
@@ -56,102 +247,251 @@ func (rc *sshExecutionContext) Port() int {
 	return rc.port
 }
 
-func remoteExec(io CommandInOut, serverAddress string, sshConfig *ssh.ClientConfig, dir, command string, arg ...string) (string, error) {
-	// Establish an SSH connection
-	sshClient, err := ssh.Dial("tcp", serverAddress, sshConfig)
+// dialSsh establishes an SSH connection, aborting the TCP dial and the handshake when ctx is done.
+func dialSsh(ctx context.Context, serverAddress string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: sshConfig.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddress)
 	if err != nil {
-		return "", fmt.Errorf("%w: failed to establish SSH connection", err)
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, connectionError(err)
 	}
+	return newSshClient(ctx, conn, serverAddress, sshConfig)
+}
 
-	defer sshClient.Close()
-
-	// Create a session on the SSH connection
-	session, err := sshClient.NewSession()
+// dialSshVia establishes an SSH connection tunneled through an already connected jump host.
+func dialSshVia(ctx context.Context, jumpClient *ssh.Client, serverAddress string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	if sshConfig.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sshConfig.Timeout)
+		defer cancel()
+	}
+	conn, err := jumpClient.DialContext(ctx, "tcp", serverAddress)
 	if err != nil {
-		return "", fmt.Errorf("%w: failed to create SSH session", err)
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, connectionError(err)
 	}
+	return newSshClient(ctx, conn, serverAddress, sshConfig)
+}
 
-	if io.In() != nil {
-		session.Stdin = io.In()
+// newSshClient runs the SSH handshake on conn, closing it on failure.
+func newSshClient(ctx context.Context, conn net.Conn, serverAddress string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	// interrupt a stuck handshake, the connection of a jump host does not support deadlines so it is closed
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+		_ = conn.Close()
+	})
+	c, chans, reqs, err := ssh.NewClientConn(conn, serverAddress, sshConfig)
+	stop()
+	if err != nil {
+		_ = conn.Close()
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, withAuthFailures(connectionError(err), sshConfig)
 	}
+	_ = conn.SetDeadline(time.Time{})
 
-	defer session.Close()
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	// Run the remote command
-	var actualCmd string
-	if dir == "" {
-		actualCmd = command
-	} else {
-		actualCmd = fmt.Sprintf("cd %s && %s", dir, command)
+// runSession runs cmd on the session. When ctx is done first, the remote
+// process is sent SIGKILL and the session is closed.
+func runSession(ctx context.Context, session *ssh.Session, cmd string) error {
+	if ctx.Done() == nil {
+		return session.Run(cmd)
 	}
 
-	logCommand(io, serverAddress, "", actualCmd, arg...)
+	if err := contextError(ctx); err != nil {
+		return err
+	}
 
-	runCmd := actualCmd
-	if len(arg) > 0 {
-		runCmd = fmt.Sprintf("%s %s", actualCmd, strings.Join(arg, " "))
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+		return contextError(ctx)
 	}
+}
 
-	output, err := session.CombinedOutput(runCmd)
-	if err != nil {
-		logCommand(io, serverAddress, "ERR", actualCmd, arg...)
+func remoteExec(ctx context.Context, io CommandInOut, conn *sshConnection, spec *commandSpec) (string, error) {
+	spec.stdin = io.In()
 
-		return "", fmt.Errorf("%w: failed to run remote command. Output: %s", err, string(output))
-	}
+	var output singleWriter
+	spec.stdout = &output
+	spec.stderr = &output
 
-	logCommand(io, serverAddress, "OK", actualCmd, arg...)
+	_, err := remoteStart(ctx, io, conn, spec)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to run remote command. Output: %s", err, output.String())
+	}
 
-	return string(output), nil
+	return output.String(), nil
 }
 
-func remoteRun(serverAddress string, sshConfig *ssh.ClientConfig, io CommandInOut, dir, command string, arg ...string) error {
-	// Establish an SSH connection
-	sshClient, err := ssh.Dial("tcp", serverAddress, sshConfig)
+func remoteRun(ctx context.Context, conn *sshConnection, io CommandInOut, spec *commandSpec) error {
+	spec.stdout, spec.stderr = serializeWriters(io.Out(), io.Err())
+	spec.stdin = io.In()
+
+	_, err := remoteStart(ctx, io, conn, spec)
 	if err != nil {
-		return fmt.Errorf("%w: failed to establish SSH connection", err)
+		return fmt.Errorf("%w when executing command: [%s]", err, remoteCommand(spec))
 	}
 
-	defer sshClient.Close()
+	return nil
+}
+
+func remoteRunWithResult(ctx context.Context, conn *sshConnection, io CommandInOut, spec *commandSpec) (*CommandResult, error) {
+	spec.stdin = io.In()
+
+	var capture resultCapture
+	capture.attach(spec, io)
 
-	// Create a session on the SSH connection
-	session, err := sshClient.NewSession()
+	result, err := remoteStart(ctx, io, conn, spec)
+	capture.fill(result)
 	if err != nil {
-		return fmt.Errorf("%w: failed to create SSH session", err)
+		return result, fmt.Errorf("%w when executing command: [%s]", err, remoteCommand(spec))
 	}
 
-	defer session.Close()
+	return result, nil
+}
 
-	// Run the remote command
-	var actualCmd string
-	if dir == "" {
-		actualCmd = command
-	} else {
-		actualCmd = fmt.Sprintf("cd %s && %s", dir, command)
+// remoteCommand returns the command, prefixed with a change of the working directory.
+// It is meant for logs and error messages, the words are not quoted.
+func remoteCommand(spec *commandSpec) string {
+	if spec.dir == "" {
+		return spec.command
 	}
+	return fmt.Sprintf("cd %s && %s", spec.dir, spec.command)
+}
 
-	logCommand(io, serverAddress, "", actualCmd, arg...)
+// remoteCommandLine returns the command line executed by the remote shell. Every word
+// is quoted, so the command behaves the same as when it is run by localExecutionContext.
+// The exported variables are set by the remote shell before the command is run.
+func remoteCommandLine(spec *commandSpec, exported Env) string {
+	command, args := spec.command, spec.args
+	if spec.env.Clean {
+		// env -i starts the command with the given variables only
+		args = append(append([]string{"-i"}, spec.env.assignments()...), append([]string{command}, args...)...)
+		command = "env"
+	}
+	commandLine := buildCommandLine(command, args...)
+	if spec.dir != "" {
+		commandLine = fmt.Sprintf("cd %s && %s", shellQuote(spec.dir), commandLine)
+	}
+	if len(exported.Vars) > 0 {
+		commandLine = fmt.Sprintf("export %s && %s", strings.Join(quoteAll(exported.assignments()), " "), commandLine)
+	}
+	return commandLine
+}
+
+// setSessionEnv passes env to the session and returns the variables rejected by the server.
+// A clean environment is not sent, it is applied by the command line.
+func setSessionEnv(session *ssh.Session, env Env) Env {
+	var rejected Env
+	if env.Clean {
+		return rejected
+	}
+	for _, name := range env.names() {
+		value := env.Vars[name]
+		if err := session.Setenv(name, value); err != nil {
+			if rejected.Vars == nil {
+				rejected.Vars = map[string]string{}
+			}
+			rejected.Vars[name] = value
+		}
+	}
+	return rejected
+}
+
+// remoteStart runs the command described by spec on a new session and waits for it to finish.
+// The result is nil when the command could not be started.
+func remoteStart(ctx context.Context, io CommandInOut, conn *sshConnection, spec *commandSpec) (*CommandResult, error) {
+	serverAddress := conn.serverAddress
+
+	if err := spec.env.validate(); err != nil {
+		return nil, err
+	}
 
-	runCmd := actualCmd
-	if len(arg) > 0 {
-		runCmd = fmt.Sprintf("%s %s", actualCmd, strings.Join(arg, " "))
+	// Create a session on the shared SSH connection
+	session, closeSession, err := conn.newSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to create SSH session", err)
 	}
 
-	if io.Err() != nil {
-		session.Stderr = io.Err()
+	defer closeSession()
+
+	if spec.stdin != nil {
+		session.Stdin = spec.stdin
 	}
-	if io.Out() != nil {
-		session.Stdout = io.Out()
+	if spec.stdout != nil {
+		session.Stdout = spec.stdout
 	}
-	if io.In() != nil {
-		session.Stdin = io.In()
+	stderrTail := newTailWriter(stderrTailSize)
+	if spec.stderr != nil {
+		session.Stderr = stdio.MultiWriter(spec.stderr, stderrTail)
+	} else {
+		session.Stderr = stderrTail
+	}
+
+	// Run the remote command
+	actualCmd := remoteCommand(spec)
+
+	logCommand(io, serverAddress, "", actualCmd, spec.args...)
+
+	rejected := setSessionEnv(session, spec.env)
+
+	runCmd := remoteCommandLine(spec, rejected)
+
+	result := &CommandResult{
+		Host:        conn.host(),
+		CommandLine: runCmd,
+		StartTime:   time.Now(),
 	}
 
-	if err := session.Run(runCmd); err != nil {
-		logCommand(io, serverAddress, "ERR", actualCmd, arg...)
-		return fmt.Errorf("%w when executing command: [%s]", err, actualCmd)
+	err = runSession(ctx, session, runCmd)
+	result.EndTime = time.Now()
+	result.ExitCode, result.Signal = remoteExitStatus(err)
+
+	if err != nil {
+		logCommand(io, serverAddress, "ERR", actualCmd, spec.args...)
+		return result, newCommandError(result, conn.host(), runCmd, stderrTail, remoteError(err))
 	}
 
-	logCommand(io, serverAddress, "OK", actualCmd, arg...)
+	logCommand(io, serverAddress, "OK", actualCmd, spec.args...)
 
-	return nil
+	return result, nil
+}
+
+// remoteError marks errors other than the exit status of the command as a lost connection.
+func remoteError(err error) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrConnection, err)
+}
+
+func remoteExitStatus(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Signal() != "" {
+			return -1, exitErr.Signal()
+		}
+		return exitErr.ExitStatus(), ""
+	}
+	return -1, ""
 }
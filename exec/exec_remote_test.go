@@ -0,0 +1,463 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	osexec "os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestRemote(t *testing.T) {
+	server := newTestSshServer(t)
+
+	t.Run("Commands share one connection", func(t *testing.T) {
+		machine := server.machine()
+		before := server.connections.Load()
+
+		for i := 0; i < 5; i++ {
+			output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "echo", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != "hello\n" {
+				t.Fatalf("not expected: [%s]", output)
+			}
+		}
+
+		if dialed := server.connections.Load() - before; dialed != 1 {
+			t.Fatalf("expected 1 connection, got %d", dialed)
+		}
+
+		if err := machine.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var buffer bytes.Buffer
+		if err := machine.RunCmd(NewCommandInOut(&buffer, &buffer, nil, nil), "", "echo", "again"); err != nil {
+			t.Fatal(err)
+		}
+		if buffer.String() != "again\n" {
+			t.Fatalf("not expected: [%s]", buffer.String())
+		}
+		if dialed := server.connections.Load() - before; dialed != 2 {
+			t.Fatalf("expected redial after Close, got %d connections", dialed)
+		}
+	})
+
+	t.Run("Idle connection is closed", func(t *testing.T) {
+		machine := server.machine(WithIdleTimeout(50 * time.Millisecond))
+		before := server.connections.Load()
+
+		if _, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if _, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true"); err != nil {
+			t.Fatal(err)
+		}
+
+		if dialed := server.connections.Load() - before; dialed != 2 {
+			t.Fatalf("expected 2 connections, got %d", dialed)
+		}
+	})
+
+	t.Run("Dropped connection is detected", func(t *testing.T) {
+		port, freeze := startFreezingProxy(t, fmt.Sprintf("127.0.0.1:%d", server.port()))
+		machine := NewSshMachine("127.0.0.1", port, server.clientConfig(), WithKeepAlive(50*time.Millisecond))
+		defer machine.Close()
+		conn := machine.(*sshExecutionContext).conn
+		before := server.connections.Load()
+
+		if _, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true"); err != nil {
+			t.Fatal(err)
+		}
+		freeze()
+		waitFor(t, func() bool {
+			conn.mu.Lock()
+			defer conn.mu.Unlock()
+			return conn.client == nil
+		})
+
+		output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "echo", "redialed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "redialed\n" {
+			t.Fatalf("not expected: [%s]", output)
+		}
+		if dialed := server.connections.Load() - before; dialed != 2 {
+			t.Fatalf("expected 2 connections, got %d", dialed)
+		}
+	})
+
+	t.Run("Slow dial does not block the machine", func(t *testing.T) {
+		// accepts connections but never answers the SSH handshake
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() {
+					_ = conn.Close()
+				})
+			}
+		}()
+		machine := NewSshMachine("127.0.0.1", listener.Addr().(*net.TCPAddr).Port, server.clientConfig())
+
+		stuck := make(chan error, 1)
+		go func() {
+			_, err := machine.ExecuteCmdContext(context.Background(), NewCommandInOut(nil, nil, nil, nil), "", "true")
+			stuck <- err
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := machine.ExecuteCmdContext(ctx, NewCommandInOut(nil, nil, nil, nil), "", "true"); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected ErrTimeout, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("blocked by the other dial: %s", elapsed)
+		}
+
+		if err := machine.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-stuck:
+			if !errors.Is(err, ErrConnection) {
+				t.Fatalf("expected ErrConnection, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("dial not canceled by Close")
+		}
+	})
+
+	t.Run("RunCmdContext timeout", func(t *testing.T) {
+		machine := server.machine()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		err := machine.RunCmdContext(ctx, NewCommandInOut(nil, nil, nil, nil), "", "sleep", "10")
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected ErrTimeout, got: %v", err)
+		}
+
+		// the connection stays usable after a killed command
+		output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "echo", "ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "ok\n" {
+			t.Fatalf("not expected: [%s]", output)
+		}
+	})
+}
+
+func TestRemoteRunCmdWithResult(t *testing.T) {
+	server := newTestSshServer(t)
+	machine := server.machine()
+
+	result, err := machine.RunCmdWithResult(context.Background(), NewCommandInOut(nil, nil, nil, nil), "", "sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if result == nil {
+		t.Fatalf("expected result")
+	}
+	if string(result.Stdout) != "out\n" || string(result.Stderr) != "err\n" {
+		t.Fatalf("not expected output: [%s] [%s]", result.Stdout, result.Stderr)
+	}
+	if result.ExitCode != 3 {
+		t.Fatalf("not expected exit code: %d", result.ExitCode)
+	}
+	if result.Host != "127.0.0.1" {
+		t.Fatalf("not expected host: [%s]", result.Host)
+	}
+	if result.CommandLine != "sh -c 'echo out; echo err >&2; exit 3'" {
+		t.Fatalf("not expected command line: [%s]", result.CommandLine)
+	}
+}
+
+func TestRemoteQuoting(t *testing.T) {
+	server := newTestSshServer(t)
+	remote := server.machine()
+	local := NewLocalMachine("test")
+
+	dir := t.TempDir() + "/dir with space"
+	if err := Mkdirs(local, NewCommandInOut(nil, nil, nil, nil), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"a b", "$HOME", "it's", "x;y", "*"}
+	expected, err := local.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), dir, "echo", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := remote.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), dir, "echo", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != expected || expected != "a b $HOME it's x;y *\n" {
+		t.Fatalf("\nlocal:\n[%s]\nremote:\n[%s]\n", expected, actual)
+	}
+
+	output, err := ExecuteShell(remote, NewCommandInOut(nil, nil, nil, nil), dir, "echo one | tr o O")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "One\n" {
+		t.Fatalf("not expected: [%s]", output)
+	}
+}
+
+func TestRemoteJumpHosts(t *testing.T) {
+	bastion1 := newTestSshServer(t)
+	bastion2 := newTestSshServer(t)
+	target := newTestSshServer(t)
+
+	jumpHost := func(server *testSshServer) JumpHost {
+		return JumpHost{Host: "127.0.0.1", Port: server.port(), SshConfig: server.clientConfig()}
+	}
+	machine := target.machine(WithJumpHosts(jumpHost(bastion1), jumpHost(bastion2)))
+
+	expected := fmt.Sprintf("test@127.0.0.1 -p %d -J test@127.0.0.1:%d,test@127.0.0.1:%d", target.port(), bastion1.port(), bastion2.port())
+	if actual := machine.(fmt.Stringer).String(); actual != expected {
+		t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+	}
+
+	expected = fmt.Sprintf("-P %d -o ProxyJump=test@127.0.0.1:%d,test@127.0.0.1:%d", target.port(), bastion1.port(), bastion2.port())
+	if actual := strings.Join(sshCommandArgs(machine, "-P"), " "); actual != expected {
+		t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+	}
+
+	for i := 0; i < 3; i++ {
+		output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "echo", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "hello\n" {
+			t.Fatalf("not expected: [%s]", output)
+		}
+	}
+
+	servers := []*testSshServer{bastion1, bastion2, target}
+	for _, server := range servers {
+		if dialed := server.connections.Load(); dialed != 1 {
+			t.Fatalf("expected 1 connection, got %d", dialed)
+		}
+	}
+
+	if err := machine.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, server := range servers {
+		for server.active.Load() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("connection not closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("Stuck handshake behind jump host", func(t *testing.T) {
+		// accepts connections but never starts the SSH handshake
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+		go func() {
+			for {
+				conn, err := silent.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() {
+					_ = conn.Close()
+				})
+			}
+		}()
+
+		bastion := newTestSshServer(t)
+		client, err := dialSsh(context.Background(), fmt.Sprintf("127.0.0.1:%d", bastion.port()), bastion.clientConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		timeoutConfig := target.clientConfig()
+		timeoutConfig.Timeout = 100 * time.Millisecond
+		dials := map[string]func() error{
+			"context": func() error {
+				_, err := dialSshVia(ctx, client, silent.Addr().String(), target.clientConfig())
+				return err
+			},
+			"timeout": func() error {
+				_, err := dialSshVia(context.Background(), client, silent.Addr().String(), timeoutConfig)
+				return err
+			},
+		}
+		for name, dial := range dials {
+			done := make(chan error, 1)
+			go func() {
+				done <- dial()
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrTimeout) {
+					t.Fatalf("%s: expected ErrTimeout, got %v", name, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: handshake not interrupted", name)
+			}
+		}
+	})
+
+	t.Run("Unreachable jump host", func(t *testing.T) {
+		bastion := newTestSshServer(t)
+		config := bastion.clientConfig()
+		config.Auth = []ssh.AuthMethod{ssh.Password("wrong")}
+		machine := target.machine(WithJumpHosts(JumpHost{Host: "127.0.0.1", Port: bastion.port(), SshConfig: config}))
+
+		_, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+		if !errors.Is(err, ErrAuthentication) {
+			t.Fatalf("expected authentication error, got %v", err)
+		}
+	})
+}
+
+func TestRemoteAgentForwarding(t *testing.T) {
+	if _, err := osexec.LookPath("ssh-add"); err != nil {
+		t.Skip("ssh-add not installed")
+	}
+	server := newTestSshServer(t)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := ssh.FingerprintSHA256(signer.PublicKey())
+
+	t.Run("Forwarded agent", func(t *testing.T) {
+		keyring := agent.NewKeyring()
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+		machine := server.machine(WithForwardedAgent(keyring))
+
+		output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "ssh-add", "-l")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(output, fingerprint) {
+			t.Fatalf("key not listed: [%s]", output)
+		}
+	})
+
+	t.Run("Local agent", func(t *testing.T) {
+		startTestAgent(t, key)
+		machine := server.machine(WithAgentForwarding())
+
+		output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "ssh-add", "-l")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(output, fingerprint) {
+			t.Fatalf("key not listed: [%s]", output)
+		}
+	})
+
+	t.Run("No local agent", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		machine := server.machine(WithAgentForwarding())
+
+		if _, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true"); err == nil {
+			t.Fatal("expected error without SSH_AUTH_SOCK")
+		}
+	})
+}
+
+// startFreezingProxy forwards connections to address. Once frozen, the connections already
+// forwarded stay open but their data is dropped, like on a silently dropped link.
+func startFreezingProxy(t *testing.T, address string) (int, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	var mutex sync.Mutex
+	var frozen []*atomic.Bool
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", address)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+				_ = target.Close()
+			})
+			dropped := &atomic.Bool{}
+			mutex.Lock()
+			frozen = append(frozen, dropped)
+			mutex.Unlock()
+			copyUnlessFrozen := func(dst, src net.Conn) {
+				buffer := make([]byte, 32*1024)
+				for {
+					n, err := src.Read(buffer)
+					if err != nil {
+						return
+					}
+					if !dropped.Load() {
+						_, _ = dst.Write(buffer[:n])
+					}
+				}
+			}
+			go copyUnlessFrozen(target, conn)
+			go copyUnlessFrozen(conn, target)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, dropped := range frozen {
+			dropped.Store(true)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTooManyFailures is returned when a rolling command is aborted after exceeding its failure threshold.
+	ErrTooManyFailures = errors.New("too many failures")
+	// ErrHealthCheckFailed is returned for machines where the health check has failed after the command.
+	ErrHealthCheckFailed = errors.New("health check failed")
+)
+
+// BatchSize is the number of machines of a rolling batch, absolute or as a percentage of all machines.
+type BatchSize struct {
+	n       int
+	percent bool
+}
+
+// BatchOf returns a batch size of n machines.
+//
+//goland:noinspection GoUnusedExportedFunction
+func BatchOf(n int) BatchSize {
+	return BatchSize{n: n}
+}
+
+// BatchPercent returns a batch size of percent of all machines, at least one machine.
+//
+//goland:noinspection GoUnusedExportedFunction
+func BatchPercent(percent int) BatchSize {
+	return BatchSize{n: percent, percent: true}
+}
+
+// ParseBatchSize parses a batch size like "5" or "25%".
+//
+//goland:noinspection GoUnusedExportedFunction
+func ParseBatchSize(s string) (BatchSize, error) {
+	value, percent := strings.CutSuffix(strings.TrimSpace(s), "%")
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || (percent && n > 100) {
+		return BatchSize{}, fmt.Errorf("invalid batch size %q", s)
+	}
+	return BatchSize{n: n, percent: percent}, nil
+}
+
+// machines returns the number of machines per batch out of total, all machines when not set.
+func (b BatchSize) machines(total int) int {
+	n := b.n
+	if b.percent {
+		n = total * b.n / 100
+	}
+	if n <= 0 {
+		n = 1
+		if b.n <= 0 {
+			n = total
+		}
+	}
+	return min(n, max(total, 1))
+}
+
+// String implements fmt.Stringer
+func (b BatchSize) String() string {
+	if b.percent {
+		return fmt.Sprintf("%d%%", b.n)
+	}
+	return strconv.Itoa(b.n)
+}
+
+// Rolling runs a command on a few machines at a time, e.g. to restart the services of a cluster.
+// The machines of a batch run the command in parallel, the next batch starts once the whole batch
+// has finished and passed the health check.
+type Rolling struct {
+	Machines  []Machine
+	BatchSize BatchSize
+	// Pause is the time waited between batches.
+	Pause time.Duration
+	// MaxFailures is the number of failed machines tolerated, the remaining batches are
+	// skipped once it is exceeded. Zero aborts after the first failure, negative never aborts.
+	MaxFailures int
+	// HealthCheck is a command with its arguments run on every machine of a batch where the command
+	// has succeeded, the machine fails with ErrHealthCheckFailed when it does not exit with zero.
+	// The remaining batches are skipped once a health check has failed, whatever MaxFailures is.
+	HealthCheck []string
+}
+
+// NewRolling creates a rolling runner over the machines with batches of batchSize machines.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewRolling(batchSize BatchSize, machines ...Machine) *Rolling {
+	return &Rolling{Machines: machines, BatchSize: batchSize}
+}
+
+// RunCmd runs the command batch after batch and returns the results in the order of the machines,
+// the machines of the batches not started are marked as skipped. The error joins the errors of all
+// failed machines, and ErrTooManyFailures or ErrHealthCheckFailed when aborted. The output of the
+// command is copied to io.Out() and io.Err(), the output of the health check is only kept in the error.
+func (r *Rolling) RunCmd(ctx context.Context, io CommandInOut, dir, command string, arg ...string) (FleetResults, error) {
+	results := make(FleetResults, 0, len(r.Machines))
+	size := r.BatchSize.machines(len(r.Machines))
+	failures := 0
+	var abortErr error
+	if prefixed, ok := io.(*PrefixedInOut); ok {
+		prefixed.Register(hosts(r.Machines)...)
+	}
+
+	for start := 0; start < len(r.Machines); start += size {
+		batch := r.Machines[start:min(start+size, len(r.Machines))]
+
+		if abortErr == nil && start > 0 && r.Pause > 0 {
+			select {
+			case <-time.After(r.Pause):
+			case <-ctx.Done():
+			}
+		}
+		if abortErr == nil {
+			abortErr = contextError(ctx)
+		}
+		if abortErr != nil {
+			for _, machine := range batch {
+				results = append(results, FleetResult{Machine: machine, Host: machine.Host(), Skipped: true, Err: contextError(ctx)})
+			}
+			continue
+		}
+
+		batchResults, _ := (&Fleet{Machines: batch}).RunCmd(ctx, io, dir, command, arg...)
+		healthy := r.checkHealth(ctx, io, dir, batchResults)
+		results = append(results, batchResults...)
+
+		failures += len(batchResults.Failed())
+		if !healthy {
+			abortErr = fmt.Errorf("%w: rollout stopped after %d of %d", ErrHealthCheckFailed, len(results), len(r.Machines))
+		} else if r.MaxFailures >= 0 && failures > r.MaxFailures {
+			abortErr = fmt.Errorf("%w: %d failed machines after %d of %d", ErrTooManyFailures, failures, len(results), len(r.Machines))
+		}
+	}
+
+	return results, errors.Join(results.Err(), abortErr)
+}
+
+// checkHealth runs the health check on the machines of the batch where the command has succeeded,
+// it returns false when a health check has failed.
+func (r *Rolling) checkHealth(ctx context.Context, io CommandInOut, dir string, batch FleetResults) bool {
+	if len(r.HealthCheck) == 0 {
+		return true
+	}
+	var machines []Machine
+	var succeeded []*FleetResult
+	for i := range batch {
+		if batch[i].Success() {
+			machines = append(machines, batch[i].Machine)
+			succeeded = append(succeeded, &batch[i])
+		}
+	}
+
+	checkIo := NewCommandInOut(nil, nil, io.Log(), nil)
+	checks, err := (&Fleet{Machines: machines}).RunCmd(ctx, checkIo, dir, r.HealthCheck[0], r.HealthCheck[1:]...)
+	for i, check := range checks {
+		if check.Err != nil {
+			succeeded[i].Err = fmt.Errorf("%w on %s: %w", ErrHealthCheckFailed, check.Host, check.Err)
+		}
+	}
+	return err == nil
+}
@@ -0,0 +1,151 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		total    int
+		expected int
+	}{
+		{"2", 5, 2},
+		{"10", 5, 5},
+		{"40%", 5, 2},
+		{"10%", 5, 1},
+		{"100%", 5, 5},
+	}
+	for _, test := range tests {
+		size, err := ParseBatchSize(test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := size.machines(test.total); actual != test.expected {
+			t.Fatalf("%s of %d: expected %d, got %d", test.size, test.total, test.expected, actual)
+		}
+		if size.String() != test.size {
+			t.Fatalf("not expected: %s", size)
+		}
+	}
+	if actual := (BatchSize{}).machines(5); actual != 5 {
+		t.Fatalf("expected all machines, got %d", actual)
+	}
+	for _, invalid := range []string{"", "0", "-1", "101%", "x%"} {
+		if _, err := ParseBatchSize(invalid); err == nil {
+			t.Fatalf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestRolling(t *testing.T) {
+	io := NewCommandInOut(nil, nil, nil, nil)
+
+	t.Run("Batches", func(t *testing.T) {
+		rolling := NewRolling(BatchOf(2), newFleetTestMachines("a", "b", "c", "d", "e")...)
+		rolling.Pause = 100 * time.Millisecond
+
+		start := time.Now()
+		results, err := rolling.RunCmd(context.Background(), io, "", "sleep", "0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 3 batches of 100ms with 2 pauses
+		if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+			t.Fatalf("batches did not run one after another: %s", elapsed)
+		}
+		for i := 2; i < len(results); i += 2 {
+			if results[i].Result.StartTime.Before(results[i-1].Result.EndTime.Add(rolling.Pause)) {
+				t.Fatalf("batch started too early: %+v", results[i])
+			}
+		}
+	})
+
+	t.Run("MaxFailures", func(t *testing.T) {
+		rolling := NewRolling(BatchPercent(40), newFleetTestMachines("a", "b!", "c!", "d", "e")...)
+		rolling.MaxFailures = 1
+
+		results, err := rolling.RunCmd(context.Background(), io, "", "true")
+		if !errors.Is(err, ErrTooManyFailures) {
+			t.Fatalf("expected ErrTooManyFailures, got: %v", err)
+		}
+		if !results[0].Success() || results[1].Success() || results[2].Success() || !results[3].Success() {
+			t.Fatalf("not expected: %v", results)
+		}
+		if !results[4].Skipped {
+			t.Fatalf("expected skipped: %+v", results[4])
+		}
+	})
+
+	t.Run("Continue on error", func(t *testing.T) {
+		rolling := NewRolling(BatchOf(1), newFleetTestMachines("a!", "b!", "c")...)
+		rolling.MaxFailures = -1
+
+		results, err := rolling.RunCmd(context.Background(), io, "", "true")
+		if err == nil || errors.Is(err, ErrTooManyFailures) {
+			t.Fatalf("not expected: %v", err)
+		}
+		if len(results.Failed()) != 2 || !results[2].Success() {
+			t.Fatalf("not expected: %v", results)
+		}
+	})
+
+	t.Run("HealthCheck", func(t *testing.T) {
+		machines := newFleetTestMachines("a", "b", "c")
+		unhealthy := machines[1].(*fleetTestMachine)
+		unhealthy.Machine = unhealthy.Machine.WithEnv(Env{Vars: map[string]string{"HEALTHY": "no"}})
+		rolling := NewRolling(BatchOf(2), machines...)
+		rolling.HealthCheck = []string{"sh", "-c", `test "$HEALTHY" != no`}
+
+		results, err := rolling.RunCmd(context.Background(), io, "", "true")
+		if !errors.Is(err, ErrHealthCheckFailed) || errors.Is(err, ErrTooManyFailures) {
+			t.Fatalf("not expected: %v", err)
+		}
+		if !results[0].Success() || !errors.Is(results[1].Err, ErrHealthCheckFailed) || results[1].ExitCode() != 0 {
+			t.Fatalf("not expected: %v", results)
+		}
+		if !results[2].Skipped {
+			t.Fatalf("expected skipped: %+v", results[2])
+		}
+	})
+
+	t.Run("HealthCheck aborts whatever MaxFailures", func(t *testing.T) {
+		machines := newFleetTestMachines("a", "b", "c", "d")
+		unhealthy := machines[0].(*fleetTestMachine)
+		unhealthy.Machine = unhealthy.Machine.WithEnv(Env{Vars: map[string]string{"HEALTHY": "no"}})
+		rolling := NewRolling(BatchOf(2), machines...)
+		rolling.MaxFailures = -1
+		rolling.HealthCheck = []string{"sh", "-c", `test "$HEALTHY" != no`}
+
+		results, err := rolling.RunCmd(context.Background(), io, "", "true")
+		if !errors.Is(err, ErrHealthCheckFailed) || errors.Is(err, ErrTooManyFailures) {
+			t.Fatalf("not expected: %v", err)
+		}
+		if !errors.Is(results[0].Err, ErrHealthCheckFailed) || !results[1].Success() {
+			t.Fatalf("not expected: %v", results)
+		}
+		for _, r := range results[2:] {
+			if !r.Skipped || r.Err != nil {
+				t.Fatalf("expected skipped: %+v", r)
+			}
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		rolling := NewRolling(BatchOf(1), newFleetTestMachines("a", "b")...)
+		rolling.Pause = time.Minute
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		results, err := rolling.RunCmd(ctx, io, "", "true")
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected ErrTimeout, got: %v", err)
+		}
+		if !results[0].Success() || !results[1].Skipped {
+			t.Fatalf("not expected: %v", results)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package exec
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// RsyncOptions are the typed options of RsyncWithOptions.
+type RsyncOptions struct {
+	// Archive preserves permissions, times, symlinks and devices (--archive).
+	Archive bool
+	// Relative keeps sourceRelativeDir in the destination path (--relative).
+	Relative bool
+	// Delete removes destination files missing in the source (--delete).
+	Delete  bool
+	Verbose bool
+	// Owner preserves the file owner (-o).
+	Owner bool
+	// Checksum compares files by checksum instead of size and time (--checksum).
+	Checksum bool
+	// Compress compresses data during the transfer (--compress).
+	Compress bool
+	// BandwidthLimit is the maximum transfer rate in KiB per second, zero is unlimited (--bwlimit).
+	BandwidthLimit int
+	// DryRun shows what would be transferred without changing anything (--dry-run).
+	DryRun bool
+	// ItemizeChanges prints a change summary for every updated file (--itemize-changes).
+	ItemizeChanges bool
+	// Stats prints transfer statistics (--stats).
+	Stats bool
+	// Partial keeps partially transferred files to resume them later (--partial).
+	Partial bool
+	// PartialDir keeps partially transferred files in this directory (--partial-dir).
+	PartialDir string
+	// Chown sets the owner and group of destination files, e.g. "user:group" (--chown).
+	Chown string
+	// Chmod changes the permissions of destination files, e.g. "D755,F644" (--chmod).
+	Chmod string
+	// Include patterns are rendered before Exclude patterns, the first matching rule wins.
+	Include []string
+	Exclude []string
+	// FilterFiles are merged as filter rules after the include and exclude patterns (--filter="merge FILE").
+	FilterFiles []string
+	// Extra options are appended as they are.
+	Extra []string
+}
+
+// DefaultRsyncOptions returns the options used by Rsync.
+func DefaultRsyncOptions() RsyncOptions {
+	return RsyncOptions{
+		Archive:  true,
+		Relative: true,
+		Delete:   true,
+		Verbose:  true,
+		Owner:    true,
+	}
+}
+
+// rsyncValueOptions are the rsync options taking their value as the next word, e.g. -e "ssh -p 2222".
+var rsyncValueOptions = map[string]bool{
+	"-e": true, "--rsh": true, "--rsync-path": true, "-f": true, "--filter": true,
+	"--include": true, "--exclude": true, "--include-from": true, "--exclude-from": true,
+	"--files-from": true, "--bwlimit": true, "--timeout": true, "--contimeout": true,
+	"--port": true, "--address": true, "--sockopts": true, "--max-size": true, "--min-size": true,
+	"--max-delete": true, "--partial-dir": true, "-T": true, "--temp-dir": true,
+	"--backup-dir": true, "--suffix": true, "--compare-dest": true, "--copy-dest": true,
+	"--link-dest": true, "--chown": true, "--chmod": true, "--usermap": true, "--groupmap": true,
+	"-B": true, "--block-size": true, "--log-file": true, "--log-file-format": true,
+	"--out-format": true, "--password-file": true, "--modify-window": true, "--iconv": true,
+	"--compress-level": true, "--skip-compress": true, "--checksum-choice": true, "--info": true,
+	"--debug": true,
+}
+
+// legacyRsyncOptions converts the options of Rsync in their order, as rsync applies the first
+// matching filter rule: words starting with a dash are passed as they are, like the value following
+// an option in rsyncValueOptions, all the others are exclude patterns.
+func legacyRsyncOptions(options []string) RsyncOptions {
+	opts := DefaultRsyncOptions()
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+		if !strings.HasPrefix(option, "-") {
+			opts.Extra = append(opts.Extra, "--exclude="+option)
+			continue
+		}
+		opts.Extra = append(opts.Extra, option)
+		if rsyncValueOptions[option] && i+1 < len(options) {
+			i++
+			opts.Extra = append(opts.Extra, options[i])
+		}
+	}
+	return opts
+}
+
+func (o RsyncOptions) args() []string {
+	var args []string
+	addFlag := func(enabled bool, flag string) {
+		if enabled {
+			args = append(args, flag)
+		}
+	}
+	addValue := func(value string, flag string) {
+		if value != "" {
+			args = append(args, flag+"="+value)
+		}
+	}
+
+	addFlag(o.Archive, "--archive")
+	addFlag(o.Relative, "--relative")
+	addFlag(o.Delete, "--delete")
+	addFlag(o.Verbose, "--verbose")
+	addFlag(o.Owner, "-o")
+	addFlag(o.Checksum, "--checksum")
+	addFlag(o.Compress, "--compress")
+	if o.BandwidthLimit > 0 {
+		addValue(strconv.Itoa(o.BandwidthLimit), "--bwlimit")
+	}
+	addFlag(o.DryRun, "--dry-run")
+	addFlag(o.ItemizeChanges, "--itemize-changes")
+	addFlag(o.Stats, "--stats")
+	addFlag(o.Partial, "--partial")
+	addValue(o.PartialDir, "--partial-dir")
+	addValue(o.Chown, "--chown")
+	addValue(o.Chmod, "--chmod")
+	for _, pattern := range o.Include {
+		addValue(pattern, "--include")
+	}
+	for _, pattern := range o.Exclude {
+		addValue(pattern, "--exclude")
+	}
+	for _, file := range o.FilterFiles {
+		addValue("merge "+file, "--filter")
+	}
+	return append(args, o.Extra...)
+}
+
+// RsyncWithOptions is Rsync with typed options.
+func RsyncWithOptions(ctx context.Context, io CommandInOut, sourceMachine Machine, sourceRootDir, sourceRelativeDir string, destinationMachine Machine, destinationRootDir string, options RsyncOptions) error {
+	_, err := rsync(ctx, io, sourceMachine, sourceRootDir, sourceRelativeDir, destinationMachine, destinationRootDir, options.args(), false)
+	return err
+}
+
+// RsyncWithReport runs RsyncWithOptions with --itemize-changes and --stats and returns the parsed
+// changes. The output is still copied to io.Out(). A skipped transfer returns an empty report.
+func RsyncWithReport(ctx context.Context, io CommandInOut, sourceMachine Machine, sourceRootDir, sourceRelativeDir string, destinationMachine Machine, destinationRootDir string, options RsyncOptions) (*SyncReport, error) {
+	options.ItemizeChanges = true
+	options.Stats = true
+	result, err := rsync(ctx, io, sourceMachine, sourceRootDir, sourceRelativeDir, destinationMachine, destinationRootDir, options.args(), true)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return &SyncReport{}, nil
+	}
+	return ParseSyncReport(string(result.Stdout)), nil
+}
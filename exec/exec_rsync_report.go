@@ -0,0 +1,151 @@
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SyncChange is a single line of the rsync --itemize-changes output.
+type SyncChange struct {
+	Path string
+	// Item is the change summary, e.g. ">f.st......", see "--itemize-changes" in the rsync manual.
+	Item string
+}
+
+// IsDir reports whether the change concerns a directory.
+func (c SyncChange) IsDir() bool {
+	return len(c.Item) > 1 && c.Item[1] == 'd'
+}
+
+// itemAttributes names the attribute letters of an itemized change by position.
+var itemAttributes = []string{"checksum", "size", "time", "permissions", "owner", "group", "atime", "acl", "xattr"}
+
+// Attributes returns the names of the attributes that changed.
+func (c SyncChange) Attributes() []string {
+	var attributes []string
+	for i, name := range itemAttributes {
+		if 2+i >= len(c.Item) {
+			break
+		}
+		switch c.Item[2+i] {
+		case '.', ' ', '+', '?':
+		default:
+			attributes = append(attributes, name)
+		}
+	}
+	return attributes
+}
+
+// SyncStats are the totals printed by rsync --stats.
+type SyncStats struct {
+	Files                    int64
+	CreatedFiles             int64
+	DeletedFiles             int64
+	TransferredFiles         int64
+	TotalFileSize            int64
+	TotalTransferredFileSize int64
+	BytesSent                int64
+	BytesReceived            int64
+	Speedup                  float64
+}
+
+// SyncReport lists the changes made by rsync.
+type SyncReport struct {
+	Created []SyncChange
+	// Updated files had their content transferred.
+	Updated []SyncChange
+	Deleted []SyncChange
+	// AttributesChanged entries only had attributes such as times or permissions changed.
+	AttributesChanged []SyncChange
+	Stats             SyncStats
+}
+
+// HasChanges reports whether anything has been created, updated, deleted or modified.
+func (r *SyncReport) HasChanges() bool {
+	return len(r.Created)+len(r.Updated)+len(r.Deleted)+len(r.AttributesChanged) > 0
+}
+
+// Summary returns a single line describing the changes.
+func (r *SyncReport) Summary() string {
+	return fmt.Sprintf("%d created, %d updated, %d deleted, %d attributes changed, %d bytes sent, speedup %.2f",
+		len(r.Created), len(r.Updated), len(r.Deleted), len(r.AttributesChanged), r.Stats.BytesSent, r.Stats.Speedup)
+}
+
+var (
+	// YXcstpoguax followed by the path
+	itemizeRegexp  = regexp.MustCompile(`^([<>ch.][fdLDS][^ ]{9}) (.+)$`)
+	deletingRegexp = regexp.MustCompile(`^\*deleting +(.+)$`)
+	statsRegexp    = regexp.MustCompile(`^([A-Za-z ]+): ([\d,]+)`)
+	speedupRegexp  = regexp.MustCompile(`speedup is ([\d,.]+)`)
+)
+
+// ParseSyncReport parses the output of rsync run with --itemize-changes and --stats.
+// Lines that are neither itemized changes nor statistics are ignored.
+func ParseSyncReport(output string) *SyncReport {
+	report := &SyncReport{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if m := deletingRegexp.FindStringSubmatch(line); m != nil {
+			report.Deleted = append(report.Deleted, SyncChange{Path: m[1], Item: "*deleting"})
+			continue
+		}
+		if m := itemizeRegexp.FindStringSubmatch(line); m != nil {
+			report.addChange(SyncChange{Path: m[2], Item: m[1]})
+			continue
+		}
+		if m := speedupRegexp.FindStringSubmatch(line); m != nil {
+			report.Stats.Speedup, _ = strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+			continue
+		}
+		if m := statsRegexp.FindStringSubmatch(line); m != nil {
+			report.Stats.set(m[1], parseStatsNumber(m[2]))
+		}
+	}
+	return report
+}
+
+func (r *SyncReport) addChange(change SyncChange) {
+	item := change.Item
+	switch {
+	case strings.Trim(item[2:], "+") == "":
+		r.Created = append(r.Created, change)
+	case item[0] == '<' || item[0] == '>':
+		r.Updated = append(r.Updated, change)
+	case len(change.Attributes()) > 0:
+		r.AttributesChanged = append(r.AttributesChanged, change)
+	case item[0] == 'c' || item[0] == 'h':
+		// local change of a symlink, device or hard link
+		r.Updated = append(r.Updated, change)
+	}
+}
+
+func (s *SyncStats) set(name string, value int64) {
+	switch name {
+	case "Number of files":
+		s.Files = value
+	case "Number of created files":
+		s.CreatedFiles = value
+	case "Number of deleted files":
+		s.DeletedFiles = value
+	case "Number of regular files transferred":
+		s.TransferredFiles = value
+	case "Total file size":
+		s.TotalFileSize = value
+	case "Total transferred file size":
+		s.TotalTransferredFileSize = value
+	case "Total bytes sent":
+		s.BytesSent = value
+	case "Total bytes received":
+		s.BytesReceived = value
+	}
+}
+
+func parseStatsNumber(value string) int64 {
+	n, _ := strconv.ParseInt(strings.ReplaceAll(value, ",", ""), 10, 64)
+	return n
+}
@@ -0,0 +1,213 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRsyncOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  RsyncOptions
+		expected string
+	}{
+		{
+			name:     "empty",
+			options:  RsyncOptions{},
+			expected: "",
+		},
+		{
+			name:     "defaults",
+			options:  DefaultRsyncOptions(),
+			expected: "--archive --relative --delete --verbose -o",
+		},
+		{
+			name: "all",
+			options: RsyncOptions{
+				Archive:        true,
+				Checksum:       true,
+				Compress:       true,
+				BandwidthLimit: 500,
+				DryRun:         true,
+				Partial:        true,
+				PartialDir:     ".rsync-partial",
+				Chown:          "app:app",
+				Chmod:          "D755,F644",
+				Include:        []string{"*/", "*.yaml"},
+				Exclude:        []string{"*"},
+				FilterFiles:    []string{"/etc/rsync/filter rules"},
+				Extra:          []string{"--info=progress2"},
+			},
+			expected: "--archive --checksum --compress --bwlimit=500 --dry-run --partial --partial-dir=.rsync-partial " +
+				"--chown=app:app --chmod=D755,F644 --include=*/ --include=*.yaml --exclude=* " +
+				"--filter=merge /etc/rsync/filter rules --info=progress2",
+		},
+		{
+			name:     "legacy",
+			options:  legacyRsyncOptions([]string{".git", "--checksum"}),
+			expected: "--archive --relative --delete --verbose -o --exclude=.git --checksum",
+		},
+		{
+			name:     "legacy with values",
+			options:  legacyRsyncOptions([]string{"--bwlimit", "100", "-e", "ssh -p 2222", ".git", "--chmod=F644", "tmp"}),
+			expected: "--archive --relative --delete --verbose -o --bwlimit 100 -e ssh -p 2222 --exclude=.git --chmod=F644 --exclude=tmp",
+		},
+		{
+			name:     "legacy filter order",
+			options:  legacyRsyncOptions([]string{"--include=keep.log", "*.log", "--include", "*.txt", "*"}),
+			expected: "--archive --relative --delete --verbose -o --include=keep.log --exclude=*.log --include *.txt --exclude=*",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := strings.Join(test.options.args(), " ")
+			if actual != test.expected {
+				t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRsyncWithOptions(t *testing.T) {
+	sm := &testExecutionContext{
+		user: "localuser",
+		host: "localhost",
+	}
+	dm := &testExecutionContext{
+		user: "remoteuser",
+		host: "remotehost",
+	}
+
+	var buffer bytes.Buffer
+	io := NewCommandInOut(&buffer, &buffer, &bytes.Buffer{}, nil)
+
+	options := RsyncOptions{Archive: true, Relative: true, DryRun: true, Exclude: []string{"*.tmp"}}
+	err := RsyncWithOptions(context.Background(), io,
+		sm, "/workspace/repo1", "build/chart",
+		dm, "/root/chart",
+		options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "rsync --archive --relative --dry-run --exclude=*.tmp /workspace/repo1/./build/chart remoteuser@remotehost:/root/chart"
+	if buffer.String() != expected {
+		t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, buffer.String())
+	}
+}
+
+const testRsyncOutput = `sending incremental file list
+*deleting   build/chart/old.yaml
+cd+++++++++ build/chart/templates/
+>f+++++++++ build/chart/templates/service.yaml
+<f.st...... build/chart/values.yaml
+.d..t...... build/chart/
+.f...p..... build/chart/Chart.yaml
+cL+++++++++ build/chart/latest -> values.yaml
+
+Number of files: 7 (reg: 4, dir: 2, link: 1)
+Number of created files: 3 (reg: 1, dir: 1, link: 1)
+Number of deleted files: 1 (reg: 1)
+Number of regular files transferred: 2
+Total file size: 12,345 bytes
+Total transferred file size: 2,048 bytes
+Literal data: 2,048 bytes
+Matched data: 0 bytes
+File list size: 0
+File list generation time: 0.001 seconds
+File list transfer time: 0.000 seconds
+Total bytes sent: 2,513
+Total bytes received: 120
+
+sent 2,513 bytes  received 120 bytes  5,266.00 bytes/sec
+total size is 12,345  speedup is 4.69
+`
+
+func TestParseSyncReport(t *testing.T) {
+	report := ParseSyncReport(testRsyncOutput)
+
+	paths := func(changes []SyncChange) string {
+		var p []string
+		for _, c := range changes {
+			p = append(p, c.Path)
+		}
+		return strings.Join(p, ",")
+	}
+
+	if actual := paths(report.Created); actual != "build/chart/templates/,build/chart/templates/service.yaml,build/chart/latest -> values.yaml" {
+		t.Errorf("created: [%s]", actual)
+	}
+	if actual := paths(report.Updated); actual != "build/chart/values.yaml" {
+		t.Errorf("updated: [%s]", actual)
+	}
+	if actual := paths(report.Deleted); actual != "build/chart/old.yaml" {
+		t.Errorf("deleted: [%s]", actual)
+	}
+	if actual := paths(report.AttributesChanged); actual != "build/chart/,build/chart/Chart.yaml" {
+		t.Errorf("attributes changed: [%s]", actual)
+	}
+	if !report.Created[0].IsDir() || report.Created[1].IsDir() {
+		t.Errorf("not expected directory flags")
+	}
+	if actual := strings.Join(report.Updated[0].Attributes(), ","); actual != "size,time" {
+		t.Errorf("attributes: [%s]", actual)
+	}
+
+	expected := SyncStats{
+		Files:                    7,
+		CreatedFiles:             3,
+		DeletedFiles:             1,
+		TransferredFiles:         2,
+		TotalFileSize:            12345,
+		TotalTransferredFileSize: 2048,
+		BytesSent:                2513,
+		BytesReceived:            120,
+		Speedup:                  4.69,
+	}
+	if report.Stats != expected {
+		t.Errorf("\nexpected:\n%+v\ngot:\n%+v", expected, report.Stats)
+	}
+	if !report.HasChanges() {
+		t.Errorf("expected changes")
+	}
+	if ParseSyncReport("sending incremental file list\n").HasChanges() {
+		t.Errorf("expected no changes")
+	}
+}
+
+func TestRsyncWithReport(t *testing.T) {
+	sm := &testExecutionContext{
+		user: "localuser",
+		host: "localhost",
+	}
+	dm := &testExecutionContext{
+		user: "remoteuser",
+		host: "remotehost",
+	}
+
+	io := NewCommandInOut(&bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}, nil)
+
+	report, err := RsyncWithReport(context.Background(), io,
+		sm, "/workspace/repo1", "build/chart",
+		dm, "/root/chart",
+		RsyncOptions{Archive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.HasChanges() {
+		t.Fatalf("not expected changes: %s", report.Summary())
+	}
+
+	report, err = RsyncWithReport(context.Background(), io,
+		sm, "/workspace/repo1", "build/chart",
+		sm, "/workspace/repo1",
+		RsyncOptions{Archive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.HasChanges() {
+		t.Fatalf("expected empty report for skipped transfer")
+	}
+}
@@ -0,0 +1,56 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// sftpFileSystem gives access to the file system of an SSH machine over SFTP.
+type sftpFileSystem struct {
+	*sftp.Client
+}
+
+func (s sftpFileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	return s.Client.ReadDir(name)
+}
+
+func (s sftpFileSystem) Open(name string) (io.ReadCloser, error) {
+	return s.Client.Open(name)
+}
+
+func (s sftpFileSystem) Create(name string) (io.WriteCloser, error) {
+	return s.Client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+// fileSystem implements fileSystemProvider with an SFTP client on the shared connection.
+func (rc *sshExecutionContext) fileSystem(ctx context.Context) (fileSystem, func(), error) {
+	client, err := rc.conn.acquire(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to establish SSH connection", err)
+	}
+	sftpClient, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		rc.conn.release()
+		return nil, nil, fmt.Errorf("%w: failed to start SFTP subsystem on %s", err, rc.host)
+	}
+	// closing the client interrupts its pending requests once the server has closed the session,
+	// release does not wait for it when ctx is done
+	closeOnDone := context.AfterFunc(ctx, func() {
+		_ = sftpClient.Close()
+	})
+	return sftpFileSystem{sftpClient}, func() {
+		if closeOnDone() {
+			_ = sftpClient.Close()
+		}
+		rc.conn.release()
+	}, nil
+}
+
+// fileSystem implements fileSystemProvider
+func (rc *localExecutionContext) fileSystem(_ctx context.Context) (fileSystem, func(), error) {
+	return localFileSystem{}, func() {}, nil
+}
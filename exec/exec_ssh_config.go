@@ -0,0 +1,433 @@
+package exec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxSshConfigIncludeDepth = 16
+
+// SshHostConfig is the OpenSSH client configuration of one host alias.
+type SshHostConfig struct {
+	Alias string
+	// HostName defaults to the alias.
+	HostName string
+	// User defaults to the local user.
+	User string
+	// Port defaults to 22.
+	Port                  int
+	IdentityFiles         []string
+	ProxyJump             string
+	StrictHostKeyChecking string
+	UserKnownHostsFile    string
+}
+
+// SshConfigFile is a parsed OpenSSH client configuration file, see ssh_config(5).
+// Host blocks with wildcards and negated patterns, Include and the first-obtained-value-wins
+// precedence are supported, Match blocks are ignored.
+type SshConfigFile struct {
+	entries []sshConfigEntry
+}
+
+type sshConfigEntry struct {
+	// patterns of the enclosing Host line, nil for global entries
+	patterns []string
+	// match is set for entries of a Match block, they never apply
+	match   bool
+	keyword string
+	value   string
+}
+
+// DefaultSshConfigPath returns the path of the user's OpenSSH client configuration.
+func DefaultSshConfigPath() string {
+	return expandHome("~/.ssh/config")
+}
+
+// ParseSshConfig reads an OpenSSH client configuration file. Relative Include paths
+// are resolved against the directory of the file.
+func ParseSshConfig(path string) (*SshConfigFile, error) {
+	config := &SshConfigFile{}
+	if err := config.parse(path, filepath.Dir(path), nil, 0); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *SshConfigFile) parse(configPath string, baseDir string, patterns []string, depth int) error {
+	if depth > maxSshConfigIncludeDepth {
+		return fmt.Errorf("too many nested includes in %s", configPath)
+	}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// a Host line in an included file applies until the end of that file only
+	match := false
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		keyword, args, err := splitSshConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%w: %s line %d", err, configPath, lineNumber)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("missing argument for %s: %s line %d", keyword, configPath, lineNumber)
+		}
+
+		switch keyword {
+		case "host":
+			patterns = args
+			match = false
+		case "match":
+			match = true
+		case "include":
+			if match {
+				continue
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				files, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%w: %s line %d", err, configPath, lineNumber)
+				}
+				for _, included := range files {
+					if err := c.parse(included, baseDir, patterns, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			c.entries = append(c.entries, sshConfigEntry{
+				patterns: patterns,
+				match:    match,
+				keyword:  keyword,
+				value:    strings.Join(args, " "),
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSshConfigLine returns the lower case keyword and the arguments of a configuration
+// line, both "Keyword value" and "Keyword=value" are accepted.
+func splitSshConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case !quoted && r == '#' && !inArg:
+			return keyword, args, nil
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return "", nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return keyword, args, nil
+}
+
+// Lookup returns the configuration of the host alias. For each keyword the first value
+// obtained wins, identity files are accumulated.
+func (c *SshConfigFile) Lookup(alias string) SshHostConfig {
+	hc := SshHostConfig{Alias: alias}
+	set := make(map[string]bool)
+	for _, entry := range c.entries {
+		if entry.match || !matchSshHostPatterns(entry.patterns, alias) {
+			continue
+		}
+		if entry.keyword == "identityfile" {
+			hc.IdentityFiles = append(hc.IdentityFiles, entry.value)
+			continue
+		}
+		if set[entry.keyword] {
+			continue
+		}
+		set[entry.keyword] = true
+		switch entry.keyword {
+		case "hostname":
+			hc.HostName = entry.value
+		case "user":
+			hc.User = entry.value
+		case "port":
+			hc.Port, _ = strconv.Atoi(entry.value)
+		case "proxyjump":
+			hc.ProxyJump = entry.value
+		case "stricthostkeychecking":
+			hc.StrictHostKeyChecking = strings.ToLower(entry.value)
+		case "userknownhostsfile":
+			// only the first of several files is used
+			hc.UserKnownHostsFile = strings.Fields(entry.value)[0]
+		}
+	}
+
+	if hc.HostName == "" {
+		hc.HostName = alias
+	} else {
+		hc.HostName = strings.ReplaceAll(hc.HostName, "%h", alias)
+	}
+	if hc.User == "" {
+		hc.User = localUserName()
+	}
+	if hc.Port == 0 {
+		hc.Port = 22
+	}
+	if hc.ProxyJump == "none" {
+		hc.ProxyJump = ""
+	}
+	for i, identityFile := range hc.IdentityFiles {
+		hc.IdentityFiles[i] = expandHome(hc.expandTokens(identityFile))
+	}
+	if hc.UserKnownHostsFile != "" {
+		hc.UserKnownHostsFile = expandHome(hc.expandTokens(hc.UserKnownHostsFile))
+	}
+	return hc
+}
+
+// expandTokens replaces the %h, %p, %r, %n, %d, %u and %% tokens.
+func (hc SshHostConfig) expandTokens(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	home, _ := os.UserHomeDir()
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", hc.HostName,
+		"%p", strconv.Itoa(hc.Port),
+		"%r", hc.User,
+		"%n", hc.Alias,
+		"%d", home,
+		"%u", localUserName(),
+	).Replace(s)
+}
+
+// matchSshHostPatterns reports whether host matches any of the patterns and none of the negated ones.
+func matchSshHostPatterns(patterns []string, host string) bool {
+	if patterns == nil {
+		return true
+	}
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for _, p := range strings.Split(pattern, ",") {
+			// path.Match treats '*' and '?' like ssh_config, host names contain no '/'
+			if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(host)); ok {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// NewSshMachineFromConfig creates an SSH machine from the host alias in ~/.ssh/config.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewSshMachineFromConfig(alias string, options ...SshOption) (Machine, error) {
+	return NewSshMachineFromConfigFile(DefaultSshConfigPath(), alias, options...)
+}
+
+// NewSshMachineFromConfigFile creates an SSH machine from the host alias in the OpenSSH
+// client configuration file. The keys of the ssh-agent and the identity files are used for
+// public key authentication, encrypted identity files are decrypted with the WithPassphrase
+// option. The known hosts file is used for host key verification unless StrictHostKeyChecking
+// is "no", new host keys are added to it when it is "accept-new". ProxyJump hosts are looked
+// up in the same file. A missing file is an empty configuration.
+func NewSshMachineFromConfigFile(configPath string, alias string, options ...SshOption) (Machine, error) {
+	config := &SshConfigFile{}
+	if _, err := os.Stat(configPath); err == nil {
+		config, err = ParseSshConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	passphrase := passphraseOption(options)
+	hc := config.Lookup(alias)
+	sshConfig, err := hc.clientConfig(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	jumpHosts, err := config.jumpHosts(hc.ProxyJump, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	sshOptions := []SshOption{WithSshCommandOptions(hc.sshCommandOptions())}
+	if len(jumpHosts) > 0 {
+		sshOptions = append(sshOptions, WithJumpHosts(jumpHosts...))
+	}
+	return NewSshMachine(hc.HostName, hc.Port, sshConfig, append(sshOptions, options...)...), nil
+}
+
+// jumpHosts converts a ProxyJump value, each [user@]host[:port] is looked up in the configuration.
+func (c *SshConfigFile) jumpHosts(proxyJump string, passphrase PassphraseFunc) ([]JumpHost, error) {
+	if proxyJump == "" {
+		return nil, nil
+	}
+	var jumpHosts []JumpHost
+	for _, jump := range strings.Split(proxyJump, ",") {
+		userName, hostPort, hasUser := strings.Cut(jump, "@")
+		if !hasUser {
+			hostPort = userName
+		}
+		host, port := hostPort, ""
+		if h, p, err := net.SplitHostPort(hostPort); err == nil {
+			host, port = h, p
+		}
+
+		hc := c.Lookup(host)
+		if hasUser {
+			hc.User = userName
+		}
+		if port != "" {
+			hc.Port, _ = strconv.Atoi(port)
+		}
+		sshConfig, err := hc.clientConfig(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("%w: jump host %s", err, jump)
+		}
+		jumpHosts = append(jumpHosts, JumpHost{Host: hc.HostName, Port: hc.Port, SshConfig: sshConfig})
+	}
+	return jumpHosts, nil
+}
+
+// clientConfig authenticates with the ssh-agent, then with the identity files. The default identity
+// files which are missing or cannot be decrypted are skipped like by ssh.
+func (hc SshHostConfig) clientConfig(passphrase PassphraseFunc) (*ssh.ClientConfig, error) {
+	auths := []SshAuth{AgentAuth()}
+	for _, identityFile := range hc.IdentityFiles {
+		auths = append(auths, KeyFileAuth(identityFile, passphrase))
+	}
+	if len(hc.IdentityFiles) == 0 {
+		for _, identityFile := range defaultIdentityFiles() {
+			if signer, err := PrivateKey(identityFile, passphrase); err == nil {
+				auths = append(auths, SignerAuth(signer))
+			}
+		}
+	}
+	methods, err := SshAuthMethods(auths...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: identity files of %s", err, hc.Alias)
+	}
+
+	hostKeyCallback, err := hc.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            hc.User,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func (hc SshHostConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	knownHostsFile := hc.knownHostsFile()
+	switch hc.StrictHostKeyChecking {
+	case "no", "off":
+		return ssh.InsecureIgnoreHostKey(), nil
+	case "accept-new":
+		return TrustOnFirstUseHostKeyCallback(knownHostsFile)
+	}
+	if _, err := os.Stat(knownHostsFile); errors.Is(err, os.ErrNotExist) {
+		// no host is known, every host key is rejected
+		return StrictHostKeyCallback()
+	}
+	return StrictHostKeyCallback(knownHostsFile)
+}
+
+func (hc SshHostConfig) knownHostsFile() string {
+	if hc.UserKnownHostsFile != "" {
+		return hc.UserKnownHostsFile
+	}
+	return expandHome("~/.ssh/known_hosts")
+}
+
+func (hc SshHostConfig) sshCommandOptions() SshCommandOptions {
+	opts := SshCommandOptions{
+		KnownHostsFile:        hc.UserKnownHostsFile,
+		StrictHostKeyChecking: hc.StrictHostKeyChecking,
+		ProxyJump:             hc.ProxyJump,
+	}
+	if len(hc.IdentityFiles) > 0 {
+		opts.IdentityFile = hc.IdentityFiles[0]
+	}
+	return opts
+}
+
+func defaultIdentityFiles() []string {
+	return []string{
+		expandHome("~/.ssh/id_ed25519"),
+		expandHome("~/.ssh/id_ecdsa"),
+		expandHome("~/.ssh/id_rsa"),
+	}
+}
+
+// expandHome replaces a leading ~ with the home directory.
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
+
+func localUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,260 @@
+package exec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestKey writes a new ed25519 private key in OpenSSH format and returns its public key.
+func writeTestKey(t *testing.T, path string) ssh.PublicKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, string(pem.EncodeToMemory(block)))
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+func TestSshConfigLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "config"), `
+# global defaults are overridden by earlier host blocks only
+Include conf.d/*.conf
+
+Host web-* !web-legacy
+    User deploy
+    IdentityFile "%d/keys/%h key"
+
+Host db
+    HostName=10.0.0.5
+    Port 2222
+    ProxyJump bastion
+
+Host *
+    User nobody
+    Port 22
+    StrictHostKeyChecking accept-new
+    IdentityFile /keys/default
+
+Match host db
+    User ignored
+`)
+	writeTestFile(t, filepath.Join(dir, "conf.d", "10-web.conf"), `
+Host web-1
+    HostName web-1.example.com
+    Port 2022
+`)
+
+	config, err := ParseSshConfig(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, _ := os.UserHomeDir()
+
+	tests := []struct {
+		alias    string
+		expected SshHostConfig
+	}{
+		{
+			alias: "web-1",
+			expected: SshHostConfig{
+				Alias:                 "web-1",
+				HostName:              "web-1.example.com",
+				User:                  "deploy",
+				Port:                  2022,
+				IdentityFiles:         []string{home + "/keys/web-1.example.com key", "/keys/default"},
+				StrictHostKeyChecking: "accept-new",
+			},
+		},
+		{
+			alias: "web-legacy",
+			expected: SshHostConfig{
+				Alias:                 "web-legacy",
+				HostName:              "web-legacy",
+				User:                  "nobody",
+				Port:                  22,
+				IdentityFiles:         []string{"/keys/default"},
+				StrictHostKeyChecking: "accept-new",
+			},
+		},
+		{
+			alias: "db",
+			expected: SshHostConfig{
+				Alias:                 "db",
+				HostName:              "10.0.0.5",
+				User:                  "nobody",
+				Port:                  2222,
+				IdentityFiles:         []string{"/keys/default"},
+				ProxyJump:             "bastion",
+				StrictHostKeyChecking: "accept-new",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.alias, func(t *testing.T) {
+			actual := config.Lookup(test.alias)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("\nexpected:\n%+v\ngot:\n%+v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNewSshMachineFromConfigFile(t *testing.T) {
+	bastion := newTestSshServer(t)
+	target := newTestSshServer(t)
+
+	dir := t.TempDir()
+	publicKey := writeTestKey(t, filepath.Join(dir, "id_ed25519"))
+	bastion.authorize(publicKey)
+	target.authorize(publicKey)
+
+	knownHosts := knownhosts.Line([]string{knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", bastion.port()))}, bastion.hostKey) + "\n" +
+		knownhosts.Line([]string{knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", target.port()))}, target.hostKey) + "\n"
+	writeTestFile(t, filepath.Join(dir, "known_hosts"), knownHosts)
+
+	configPath := filepath.Join(dir, "config")
+	writeTestFile(t, configPath, fmt.Sprintf(`
+Host target
+    HostName 127.0.0.1
+    Port %d
+    ProxyJump bastion
+
+Host bastion
+    HostName 127.0.0.1
+    Port %d
+
+Host *
+    User test
+    IdentityFile %s/id_ed25519
+    UserKnownHostsFile %s/known_hosts
+`, target.port(), bastion.port(), dir, dir))
+
+	machine, err := NewSshMachineFromConfigFile(configPath, "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+
+	expected := fmt.Sprintf("test@127.0.0.1 -p %d -J test@127.0.0.1:%d", target.port(), bastion.port())
+	if actual := machine.(fmt.Stringer).String(); actual != expected {
+		t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, actual)
+	}
+
+	output, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "echo", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "hello\n" {
+		t.Fatalf("not expected: [%s]", output)
+	}
+	if bastion.connections.Load() != 1 || target.connections.Load() != 1 {
+		t.Fatalf("expected connection through the bastion")
+	}
+
+	t.Run("Unknown host key", func(t *testing.T) {
+		writeTestFile(t, filepath.Join(dir, "known_hosts"), "")
+		machine, err := NewSshMachineFromConfigFile(configPath, "bastion")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer machine.Close()
+		if _, err := machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true"); err == nil {
+			t.Fatal("expected host key error")
+		}
+	})
+}
+
+func TestNewSshMachineFromConfigFileEncryptedDefaultKey(t *testing.T) {
+	server := newTestSshServer(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(home, ".ssh", "id_ed25519"), string(pem.EncodeToMemory(block)))
+	// an unencrypted default key not accepted by the server
+	writeTestKey(t, filepath.Join(home, ".ssh", "id_rsa"))
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.authorize(signer.PublicKey())
+
+	configPath := filepath.Join(home, ".ssh", "config")
+	writeTestFile(t, configPath, fmt.Sprintf(`
+Host target
+    HostName 127.0.0.1
+    Port %d
+    User test
+    StrictHostKeyChecking no
+`, server.port()))
+
+	run := func(t *testing.T, options ...SshOption) error {
+		machine, err := NewSshMachineFromConfigFile(configPath, "target", options...)
+		if err != nil {
+			return err
+		}
+		defer machine.Close()
+		_, err = machine.ExecuteCmd(NewCommandInOut(nil, nil, nil, nil), "", "true")
+		return err
+	}
+
+	t.Run("Skipped", func(t *testing.T) {
+		if err := run(t); !errors.Is(err, ErrAuthentication) {
+			t.Fatalf("expected authentication error, got %v", err)
+		}
+	})
+
+	t.Run("Passphrase", func(t *testing.T) {
+		passphrase := func(string) ([]byte, error) {
+			return []byte("secret"), nil
+		}
+		if err := run(t, WithPassphrase(passphrase)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Agent", func(t *testing.T) {
+		startTestAgent(t, key)
+		if err := run(t); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,357 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeepAliveInterval = 30 * time.Second
+	defaultIdleTimeout       = 5 * time.Minute
+	keepAliveRequest         = "keepalive@openssh.com"
+	// keepAliveCountMax is the number of keepalive intervals without reply after which
+	// the connection is considered dropped, like ServerAliveCountMax of ssh
+	keepAliveCountMax = 3
+)
+
+// sshConnection is a lazily dialed SSH client shared by all sessions of one machine.
+// The client is closed after it has been idle for idleTimeout and redialed on demand,
+// also when the keepalive detects that the connection has dropped.
+type sshConnection struct {
+	serverAddress string
+	sshConfig     *ssh.ClientConfig
+	keepAlive     time.Duration
+	idleTimeout   time.Duration
+	jumpHosts     []JumpHost
+	// forwardAgent enables agent forwarding on every session, agent is served to the
+	// remote host, or the agent listening on SSH_AUTH_SOCK when it is nil
+	forwardAgent bool
+	agent        agent.Agent
+
+	mu        sync.Mutex
+	client    *ssh.Client
+	dialing   *sshDial
+	users     int
+	idleTimer *time.Timer
+}
+
+func newSshConnection(serverAddress string, sshConfig *ssh.ClientConfig) *sshConnection {
+	return &sshConnection{
+		serverAddress: serverAddress,
+		sshConfig:     sshConfig,
+		keepAlive:     defaultKeepAliveInterval,
+		idleTimeout:   defaultIdleTimeout,
+	}
+}
+
+func (c *sshConnection) host() string {
+	host, _, err := net.SplitHostPort(c.serverAddress)
+	if err != nil {
+		return c.serverAddress
+	}
+	return host
+}
+
+// acquire returns the shared client, dialing it when needed. Every successful
+// call must be paired with a call to release.
+func (c *sshConnection) acquire(ctx context.Context) (*ssh.Client, error) {
+	for {
+		c.mu.Lock()
+		if c.client != nil {
+			client := c.client
+			c.stopIdleTimer()
+			c.users++
+			c.mu.Unlock()
+			return client, nil
+		}
+		d := c.dialing
+		if d == nil {
+			d = c.startDial()
+		}
+		d.waiters++
+		c.mu.Unlock()
+
+		select {
+		case <-d.done:
+			if d.err != nil {
+				return nil, d.err
+			}
+			// the client has been published, take it unless already discarded
+		case <-ctx.Done():
+			c.mu.Lock()
+			d.waiters--
+			if d.waiters == 0 && c.dialing == d {
+				// nobody waits for the connection anymore
+				d.cancel()
+				c.dialing = nil
+			}
+			c.mu.Unlock()
+			return nil, contextError(ctx)
+		}
+	}
+}
+
+// sshDial is a dial in progress, shared by all callers of acquire waiting for a client.
+type sshDial struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	err     error
+}
+
+// startDial dials without holding the mutex, so that Close and callers giving up are not
+// blocked by a slow server. The client is published once connected. Must be called with the
+// mutex held.
+func (c *sshConnection) startDial() *sshDial {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &sshDial{done: make(chan struct{}), cancel: cancel}
+	c.dialing = d
+
+	go func() {
+		defer cancel()
+		client, err := c.dial(ctx)
+		if err == nil {
+			if err = c.serveAgent(client); err != nil {
+				_ = client.Close()
+			}
+		}
+
+		c.mu.Lock()
+		if c.dialing == d {
+			c.dialing = nil
+			if err == nil {
+				c.client = client
+				go c.monitor(client)
+			}
+		} else {
+			// abandoned by its callers or by Close
+			if err == nil {
+				_ = client.Close()
+			}
+			err = fmt.Errorf("%w: closed while connecting to %s", ErrConnection, c.serverAddress)
+		}
+		d.err = err
+		c.mu.Unlock()
+		close(d.done)
+	}()
+	return d
+}
+
+func (c *sshConnection) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users--
+	if c.users > 0 || c.client == nil || c.idleTimeout <= 0 {
+		return
+	}
+	client := c.client
+	c.idleTimer = time.AfterFunc(c.idleTimeout, func() {
+		c.closeIdle(client)
+	})
+}
+
+// dial connects to the server, through the jump hosts if any. The jump host
+// connections are closed once the connection to the server is closed.
+func (c *sshConnection) dial(ctx context.Context) (*ssh.Client, error) {
+	if len(c.jumpHosts) == 0 {
+		return dialSsh(ctx, c.serverAddress, c.sshConfig)
+	}
+
+	var chain []*ssh.Client
+	closeChain := func() {
+		for i := len(chain) - 1; i >= 0; i-- {
+			_ = chain[i].Close()
+		}
+	}
+
+	jumpHost := c.jumpHosts[0]
+	client, err := dialSsh(ctx, jumpHost.address(), jumpHost.SshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to connect to jump host %s", err, jumpHost)
+	}
+	chain = append(chain, client)
+
+	for _, jumpHost := range c.jumpHosts[1:] {
+		client, err = dialSshVia(ctx, client, jumpHost.address(), jumpHost.SshConfig)
+		if err != nil {
+			closeChain()
+			return nil, fmt.Errorf("%w: failed to connect to jump host %s", err, jumpHost)
+		}
+		chain = append(chain, client)
+	}
+
+	client, err = dialSshVia(ctx, client, c.serverAddress, c.sshConfig)
+	if err != nil {
+		closeChain()
+		return nil, err
+	}
+
+	go func() {
+		_ = client.Wait()
+		closeChain()
+	}()
+	return client, nil
+}
+
+// serveAgent answers the agent requests of the remote host when agent forwarding is enabled.
+func (c *sshConnection) serveAgent(client *ssh.Client) error {
+	if !c.forwardAgent {
+		return nil
+	}
+	if c.agent != nil {
+		return agent.ForwardToAgent(client, c.agent)
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return errors.New("cannot forward ssh-agent, SSH_AUTH_SOCK is not set")
+	}
+	return agent.ForwardToRemote(client, socket)
+}
+
+// proxyJump returns the jump hosts in the format of the ssh -J option.
+func (c *sshConnection) proxyJump() string {
+	jumps := make([]string, len(c.jumpHosts))
+	for i, jumpHost := range c.jumpHosts {
+		jumps[i] = jumpHost.String()
+	}
+	return strings.Join(jumps, ",")
+}
+
+// newSession opens a session on the shared client. A client that can no longer
+// open sessions is discarded and redialed once. The returned function must be
+// called when the session is no longer used.
+func (c *sshConnection) newSession(ctx context.Context) (*ssh.Session, func(), error) {
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		client, err := c.acquire(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err := client.NewSession()
+		if err == nil && c.forwardAgent {
+			if err := agent.RequestAgentForwarding(session); err != nil {
+				_ = session.Close()
+				c.release()
+				return nil, nil, fmt.Errorf("%w: agent forwarding rejected by %s", err, c.host())
+			}
+		}
+		if err == nil {
+			return session, func() {
+				_ = session.Close()
+				c.release()
+			}, nil
+		}
+		lastErr = err
+		c.discard(client)
+		_ = client.Close()
+		c.release()
+	}
+	return nil, nil, fmt.Errorf("%w: %w", ErrConnection, lastErr)
+}
+
+// monitor sends keepalive requests and forgets the client once the connection is gone.
+func (c *sshConnection) monitor(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+
+	var tick <-chan time.Time
+	if c.keepAlive > 0 {
+		ticker := time.NewTicker(c.keepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			c.discard(client)
+			return
+		case <-tick:
+			if !c.sendKeepAlive(client, done) {
+				c.discard(client)
+				_ = client.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendKeepAlive reports whether the server has replied to a keepalive request in time. A silently
+// dropped connection blocks the request until the TCP timeout of the system, so it is not waited for.
+func (c *sshConnection) sendKeepAlive(client *ssh.Client, done <-chan struct{}) bool {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepAliveRequest, true, nil)
+		reply <- err
+	}()
+
+	timer := time.NewTimer(c.keepAlive * keepAliveCountMax)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *sshConnection) discard(client *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == client {
+		c.client = nil
+		c.stopIdleTimer()
+	}
+}
+
+func (c *sshConnection) closeIdle(client *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != client || c.users > 0 {
+		return
+	}
+	c.client = nil
+	_ = client.Close()
+}
+
+func (c *sshConnection) stopIdleTimer() {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+}
+
+// Close closes the shared client and cancels a dial in progress. Sessions still running
+// on it are terminated, the next command dials a new connection.
+func (c *sshConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopIdleTimer()
+	if c.dialing != nil {
+		c.dialing.cancel()
+		c.dialing = nil
+	}
+	if c.client == nil {
+		return nil
+	}
+	client := c.client
+	c.client = nil
+	return client.Close()
+}
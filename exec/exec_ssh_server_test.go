@@ -0,0 +1,438 @@
+package exec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSshServer is a minimal in-process SSH server that runs "exec" requests with the local shell.
+type testSshServer struct {
+	t           *testing.T
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	connections atomic.Int32
+	// active counts the connections that are still open
+	active atomic.Int32
+	// rejectEnv makes the server refuse "env" requests like sshd without AcceptEnv
+	rejectEnv atomic.Bool
+	hostKey   ssh.PublicKey
+	// authorizedKeys holds the marshaled public keys accepted for the user "test"
+	authorizedKeys sync.Map
+	// userAuthorities holds the marshaled keys of the CAs signing accepted user certificates
+	userAuthorities sync.Map
+}
+
+func newTestSshServer(t *testing.T) *testSshServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "test" && string(password) == "test" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+		if err == nil && c.User() == "test" && len(answers) == 1 && answers[0] == "test" {
+			return nil, nil
+		}
+		return nil, io.EOF
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSshServer{
+		t:        t,
+		listener: listener,
+		config:   config,
+		hostKey:  hostSigner.PublicKey(),
+	}
+	userCertChecker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			_, ok := s.userAuthorities.Load(string(auth.Marshal()))
+			return ok
+		},
+	}
+	config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if _, ok := key.(*ssh.Certificate); ok {
+			return userCertChecker.Authenticate(c, key)
+		}
+		if _, ok := s.authorizedKeys.Load(string(key.Marshal())); ok && c.User() == "test" {
+			return nil, nil
+		}
+		return nil, io.EOF
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return s
+}
+
+func (s *testSshServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// authorize makes the server accept public key authentication with key.
+func (s *testSshServer) authorize(key ssh.PublicKey) {
+	s.authorizedKeys.Store(string(key.Marshal()), true)
+}
+
+// trustUserAuthority makes the server accept user certificates signed by ca.
+func (s *testSshServer) trustUserAuthority(ca ssh.PublicKey) {
+	s.userAuthorities.Store(string(ca.Marshal()), true)
+}
+
+func (s *testSshServer) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("test")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+func (s *testSshServer) machine(options ...SshOption) Machine {
+	m := NewSshMachine("127.0.0.1", s.port(), s.clientConfig(), options...)
+	s.t.Cleanup(func() {
+		_ = m.Close()
+	})
+	return m
+}
+
+func (s *testSshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testSshServer) handleConn(conn net.Conn) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	s.connections.Add(1)
+	s.active.Add(1)
+	defer s.active.Add(-1)
+	defer serverConn.Close()
+
+	go s.handleGlobalRequests(serverConn, reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.handleDirectTcpip(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(serverConn, channel, requests)
+	}
+}
+
+// handleGlobalRequests supports remote port forwarding with "tcpip-forward" requests.
+func (s *testSshServer) handleGlobalRequests(serverConn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}()
+
+	for req := range reqs {
+		if req.Type != "tcpip-forward" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		var payload struct {
+			Addr string
+			Port uint32
+		}
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		listeners = append(listeners, listener)
+		port := uint32(listener.Addr().(*net.TCPAddr).Port)
+		_ = req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				origin := conn.RemoteAddr().(*net.TCPAddr)
+				channel, requests, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)}))
+				if err != nil {
+					_ = conn.Close()
+					continue
+				}
+				go ssh.DiscardRequests(requests)
+				go pipeTestConn(conn, channel)
+			}
+		}()
+	}
+}
+
+// forwardAgent listens on a unix socket and forwards its connections to the client agent.
+func (s *testSshServer) forwardAgent(serverConn *ssh.ServerConn) (net.Listener, error) {
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer os.RemoveAll(dir)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			channel, requests, err := serverConn.OpenChannel("auth-agent@openssh.com", nil)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go pipeTestConn(conn, channel)
+		}
+	}()
+	return listener, nil
+}
+
+func pipeTestConn(conn net.Conn, channel ssh.Channel) {
+	go func() {
+		_, _ = io.Copy(channel, conn)
+		_ = channel.CloseWrite()
+	}()
+	_, _ = io.Copy(conn, channel)
+	_ = conn.Close()
+	_ = channel.Close()
+}
+
+// handleDirectTcpip forwards a channel to the requested address, as used by jump hosts.
+func (s *testSshServer) handleDirectTcpip(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	pipeTestConn(conn, channel)
+}
+
+func (s *testSshServer) handleSession(serverConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var env []string
+	var cmd *exec.Cmd
+	// set when a pseudo-terminal has been requested
+	var ptyReq *struct {
+		Term          string
+		Columns, Rows uint32
+		Width, Height uint32
+		Modes         string
+	}
+	var ptmx *os.File
+	done := make(chan struct{})
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &kv); err != nil || s.rejectEnv.Load() {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			env = append(env, kv.Name+"="+kv.Value)
+			_ = req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || cmd != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.WaitDelay = 100 * time.Millisecond
+			copied := make(chan struct{})
+			if ptyReq != nil {
+				cmd.Env = append(append(os.Environ(), env...), "TERM="+ptyReq.Term)
+				var err error
+				ptmx, err = pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(ptyReq.Columns), Rows: uint16(ptyReq.Rows)})
+				if err != nil {
+					_ = req.Reply(false, nil)
+					return
+				}
+				go func() {
+					_, _ = io.Copy(ptmx, channel)
+				}()
+				go func() {
+					_, _ = io.Copy(channel, ptmx)
+					close(copied)
+				}()
+			} else {
+				cmd.Env = env
+				cmd.Stdin = channel
+				cmd.Stdout = channel
+				cmd.Stderr = channel.Stderr()
+				close(copied)
+				if err := cmd.Start(); err != nil {
+					_ = req.Reply(false, nil)
+					return
+				}
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				defer close(done)
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						status = exitErr.ExitCode()
+						if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+							status = 128 + int(ws.Signal())
+						}
+					} else {
+						status = 255
+					}
+				}
+				select {
+				case <-copied:
+				case <-time.After(time.Second):
+				}
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, uint32(status))
+				_, _ = channel.SendRequest("exit-status", false, payload)
+				_ = channel.CloseWrite()
+				_ = channel.Close()
+			}()
+		case "pty-req":
+			ptyReq = &struct {
+				Term          string
+				Columns, Rows uint32
+				Width, Height uint32
+				Modes         string
+			}{}
+			if err := ssh.Unmarshal(req.Payload, ptyReq); err != nil {
+				ptyReq = nil
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+		case "window-change":
+			var size struct{ Columns, Rows, Width, Height uint32 }
+			if err := ssh.Unmarshal(req.Payload, &size); err == nil && ptmx != nil {
+				_ = pty.Setsize(ptmx, &pty.Winsize{Cols: uint16(size.Columns), Rows: uint16(size.Rows)})
+			}
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				server, err := sftp.NewServer(channel)
+				if err == nil {
+					_ = server.Serve()
+				}
+				_ = channel.Close()
+			}()
+		case "auth-agent-req@openssh.com":
+			socket, err := s.forwardAgent(serverConn)
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			defer socket.Close()
+			env = append(env, "SSH_AUTH_SOCK="+socket.Addr().String())
+			_ = req.Reply(true, nil)
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				_ = cmd.Process.Kill()
+			}
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+	if ptmx != nil {
+		defer ptmx.Close()
+	}
+	if cmd != nil && cmd.Process != nil {
+		select {
+		case <-done:
+		default:
+			_ = cmd.Process.Kill()
+		}
+	}
+}
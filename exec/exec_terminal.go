@@ -0,0 +1,265 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	stdio "io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultTerm           = "xterm-256color"
+	defaultTerminalWidth  = 80
+	defaultTerminalHeight = 24
+)
+
+// ErrInteractiveNotSupported is returned when a machine cannot run interactive commands.
+var ErrInteractiveNotSupported = errors.New("interactive commands not supported")
+
+// TerminalSize is the size of a terminal in characters.
+type TerminalSize struct {
+	Width  int
+	Height int
+}
+
+// TerminalOptions configures RunInteractive.
+type TerminalOptions struct {
+	// Term is the terminal type, by default $TERM or xterm-256color.
+	Term string
+	// Size is the initial size, by default the size of the local terminal or 80x24.
+	Size TerminalSize
+	// Resize receives size changes, by default the size of the local terminal is followed.
+	Resize <-chan TerminalSize
+}
+
+// interactiveRunner is implemented by machines able to run commands on a pseudo-terminal.
+type interactiveRunner interface {
+	runInteractive(ctx context.Context, io CommandInOut, terminal *terminal, spec *commandSpec) error
+}
+
+// terminal is the pseudo-terminal requested for an interactive command.
+type terminal struct {
+	term   string
+	size   TerminalSize
+	resize <-chan TerminalSize
+}
+
+// followResize calls setSize for every size change until done is closed.
+func (t *terminal) followResize(done <-chan struct{}, setSize func(size TerminalSize)) {
+	if t.resize == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case size, ok := <-t.resize:
+				if !ok {
+					return
+				}
+				setSize(size)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// RunInteractive runs the command on a pseudo-terminal of the machine: a pty pair for the local
+// machine, a PTY requested on the session for SSH machines. An empty command starts a login shell.
+// When io.In() is a terminal it is put into raw mode and restored on return, and its size changes
+// are forwarded. Standard error is merged into io.Out() by the pseudo-terminal.
+// The input of a file like os.Stdin is no longer read once the command has finished, other readers
+// of io.In() cannot be interrupted and the input of a read pending at that time is lost.
+//
+//goland:noinspection GoUnusedExportedFunction
+func RunInteractive(ctx context.Context, machine Machine, io CommandInOut, options TerminalOptions, dir, command string, arg ...string) error {
+	runner, ok := machine.(interactiveRunner)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrInteractiveNotSupported, machine.Host())
+	}
+
+	t := &terminal{
+		term:   options.Term,
+		size:   options.Size,
+		resize: options.Resize,
+	}
+	if t.term == "" {
+		t.term = os.Getenv("TERM")
+	}
+	if t.term == "" {
+		t.term = defaultTerm
+	}
+
+	if in, ok := io.In().(*os.File); ok && term.IsTerminal(int(in.Fd())) {
+		fd := int(in.Fd())
+		if t.size == (TerminalSize{}) {
+			if width, height, err := term.GetSize(fd); err == nil {
+				t.size = TerminalSize{Width: width, Height: height}
+			}
+		}
+		if t.resize == nil {
+			resize, stop := notifyTerminalResize(fd)
+			defer stop()
+			t.resize = resize
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("%w: cannot put the terminal into raw mode", err)
+		}
+		defer func() {
+			_ = term.Restore(fd, state)
+		}()
+	}
+	if t.size.Width <= 0 || t.size.Height <= 0 {
+		t.size = TerminalSize{Width: defaultTerminalWidth, Height: defaultTerminalHeight}
+	}
+
+	if io.In() != nil {
+		in, stop := interruptibleInput(io.In())
+		defer stop()
+		io = NewCommandInOut(io.Out(), io.Err(), io.Log(), in)
+	}
+
+	spec := newCommandSpec(dir, command, arg...)
+	return runner.runInteractive(ctx, io, t, spec)
+}
+
+// runInteractive implements interactiveRunner
+func (rc *localExecutionContext) runInteractive(ctx context.Context, io CommandInOut, t *terminal, spec *commandSpec) error {
+	spec.env = rc.env
+	if err := spec.env.validate(); err != nil {
+		return err
+	}
+	if spec.command == "" {
+		spec.command = os.Getenv("SHELL")
+		if spec.command == "" {
+			spec.command = "/bin/sh"
+		}
+		spec.args = []string{"-l"}
+	}
+
+	// pty starts the command in a new session, which is killed as a whole by closing the pty
+	cmd := exec.CommandContext(ctx, spec.command, spec.args...)
+	cmd.Dir = spec.dir
+	cmd.WaitDelay = localWaitDelay
+	if !spec.env.isEmpty() {
+		cmd.Env = spec.env.environ(os.Environ())
+	}
+	if _, ok := spec.env.Vars["TERM"]; !ok {
+		cmd.Env = append(cmd.Environ(), "TERM="+t.term)
+	}
+
+	logCommand(io, "localhost", "", spec.command, spec.args...)
+
+	commandLine := buildCommandLine(spec.command, spec.args...)
+	result := &CommandResult{
+		Host:        "localhost",
+		CommandLine: commandLine,
+		ExitCode:    -1,
+		StartTime:   time.Now(),
+	}
+
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(t.size.Width), Rows: uint16(t.size.Height)})
+	if err != nil {
+		return localCommandError(nil, cmd, commandLine, nil, err)
+	}
+	defer ptmx.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	t.followResize(done, func(size TerminalSize) {
+		_ = pty.Setsize(ptmx, &pty.Winsize{Cols: uint16(size.Width), Rows: uint16(size.Height)})
+	})
+
+	if in := io.In(); in != nil {
+		go func() {
+			_, _ = stdio.Copy(ptmx, in)
+		}()
+	}
+	output := stdio.Discard
+	if io.Out() != nil {
+		output = io.Out()
+	}
+	// reading fails with EIO once the command and its children have closed the terminal
+	copied := make(chan struct{})
+	go func() {
+		_, _ = stdio.Copy(output, ptmx)
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	select {
+	case <-copied:
+	case <-time.After(localWaitDelay):
+	}
+	result.EndTime = time.Now()
+	result.ExitCode = cmd.ProcessState.ExitCode()
+	result.Signal = exitSignal(cmd.ProcessState)
+
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			err = ctxErr
+		}
+		return localCommandError(result, cmd, commandLine, nil, err)
+	}
+	return nil
+}
+
+// runInteractive implements interactiveRunner
+func (rc *sshExecutionContext) runInteractive(ctx context.Context, io CommandInOut, t *terminal, spec *commandSpec) error {
+	spec.env = rc.env
+	if err := spec.env.validate(); err != nil {
+		return err
+	}
+	if spec.command == "" {
+		spec.command = "sh"
+		spec.args = []string{"-c", `exec "${SHELL:-/bin/sh}" -l`}
+	}
+
+	session, closeSession, err := rc.conn.newSession(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: failed to create SSH session", err)
+	}
+	defer closeSession()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(t.term, t.size.Height, t.size.Width, modes); err != nil {
+		return fmt.Errorf("%w: failed to allocate a PTY on %s", err, rc.host)
+	}
+	session.Stdin = io.In()
+	session.Stdout = io.Out()
+	session.Stderr = io.Err()
+
+	done := make(chan struct{})
+	defer close(done)
+	t.followResize(done, func(size TerminalSize) {
+		_ = session.WindowChange(size.Height, size.Width)
+	})
+
+	actualCmd := remoteCommand(spec)
+	logCommand(io, rc.conn.serverAddress, "", actualCmd, spec.args...)
+
+	runCmd := remoteCommandLine(spec, setSessionEnv(session, spec.env))
+	result := &CommandResult{
+		Host:        rc.host,
+		CommandLine: runCmd,
+		StartTime:   time.Now(),
+	}
+	err = runSession(ctx, session, runCmd)
+	result.EndTime = time.Now()
+	result.ExitCode, result.Signal = remoteExitStatus(err)
+	if err != nil {
+		return newCommandError(result, rc.host, runCmd, nil, remoteError(err))
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package exec
+
+import (
+	stdio "io"
+)
+
+// notifyTerminalResize is not supported, there is no SIGWINCH.
+func notifyTerminalResize(_fd int) (<-chan TerminalSize, func()) {
+	return nil, func() {}
+}
+
+// interruptibleInput is not supported, a read of in pending when the command finishes consumes its input.
+func interruptibleInput(in stdio.Reader) (stdio.Reader, func()) {
+	return in, func() {}
+}
@@ -0,0 +1,116 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunInteractive(t *testing.T) {
+	server := newTestSshServer(t)
+	machines := map[string]Machine{
+		"Local":  NewLocalMachine(""),
+		"Remote": server.machine(),
+	}
+
+	for name, machine := range machines {
+		t.Run(name, func(t *testing.T) {
+			t.Run("Terminal", func(t *testing.T) {
+				out := &singleWriter{}
+				io := NewCommandInOut(out, out, nil, strings.NewReader(""))
+				options := TerminalOptions{Term: "vt100", Size: TerminalSize{Width: 100, Height: 30}}
+
+				err := RunInteractive(context.Background(), machine, io, options, "",
+					"sh", "-c", `test -t 0 && test -t 1 && stty size && echo "$TERM"`)
+				if err != nil {
+					t.Fatalf("%v: %s", err, out.String())
+				}
+				if actual := strings.ReplaceAll(out.String(), "\r\n", "\n"); actual != "30 100\nvt100\n" {
+					t.Fatalf("not expected: [%s]", actual)
+				}
+			})
+
+			t.Run("Resize", func(t *testing.T) {
+				out := &singleWriter{}
+				in, input := io.Pipe()
+				defer input.Close()
+				resize := make(chan TerminalSize)
+				options := TerminalOptions{Size: TerminalSize{Width: 80, Height: 24}, Resize: resize}
+
+				done := make(chan error, 1)
+				go func() {
+					done <- RunInteractive(context.Background(), machine, NewCommandInOut(out, out, nil, in), options, "",
+						"sh", "-c", `stty size; while read line && [ "$line" != q ]; do stty size; done`)
+				}()
+
+				waitFor(t, func() bool {
+					return strings.Contains(out.String(), "24 80")
+				})
+				resize <- TerminalSize{Width: 120, Height: 40}
+				// the new size is applied asynchronously, ask for it until it shows
+				waitFor(t, func() bool {
+					_, _ = input.Write([]byte("\n"))
+					return strings.Contains(out.String(), "40 120")
+				})
+				if _, err := input.Write([]byte("q\n")); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			t.Run("Input not read after return", func(t *testing.T) {
+				in, input, err := os.Pipe()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer in.Close()
+				defer input.Close()
+
+				err = RunInteractive(context.Background(), machine, NewCommandInOut(nil, nil, nil, in), TerminalOptions{}, "", "true")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := input.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				read := make(chan string, 1)
+				go func() {
+					buffer := make([]byte, 1)
+					n, _ := in.Read(buffer)
+					read <- string(buffer[:n])
+				}()
+				select {
+				case actual := <-read:
+					if actual != "x" {
+						t.Fatalf("not expected: [%s]", actual)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("input consumed after return")
+				}
+			})
+
+			t.Run("Exit status", func(t *testing.T) {
+				io := NewCommandInOut(nil, nil, nil, strings.NewReader(""))
+				err := RunInteractive(context.Background(), machine, io, TerminalOptions{}, "", "sh", "-c", "exit 3")
+				var cmdErr *CommandError
+				if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 3 {
+					t.Fatalf("expected exit code 3, got %v", err)
+				}
+			})
+		})
+	}
+
+	t.Run("Not supported", func(t *testing.T) {
+		machine := &testExecutionContext{user: "user", host: "host"}
+		err := RunInteractive(context.Background(), machine, NewCommandInOut(nil, nil, nil, nil), TerminalOptions{}, "", "true")
+		if !errors.Is(err, ErrInteractiveNotSupported) {
+			t.Fatalf("expected not supported, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+//go:build unix
+
+package exec
+
+import (
+	stdio "io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// notifyTerminalResize sends the size of the terminal fd whenever it changes, until stop is called.
+func notifyTerminalResize(fd int) (<-chan TerminalSize, func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	resize := make(chan TerminalSize, 1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				width, height, err := term.GetSize(fd)
+				if err != nil {
+					continue
+				}
+				select {
+				case resize <- TerminalSize{Width: width, Height: height}:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return resize, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// interruptibleInput returns a reader of the file in whose pending read is interrupted by stop, so that
+// no input is consumed once the command has finished. The file is read through a non-blocking duplicate
+// of its descriptor, the blocking mode shared with in is restored by stop. Other readers are returned
+// as they are.
+func interruptibleInput(in stdio.Reader) (stdio.Reader, func()) {
+	f, ok := in.(*os.File)
+	if !ok {
+		return in, func() {}
+	}
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return in, func() {}
+	}
+	var fd int
+	var dupErr error
+	if err := raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	}); err != nil || dupErr != nil {
+		return in, func() {}
+	}
+
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	blocking := err == nil && flags&unix.O_NONBLOCK == 0
+	if err != nil || syscall.SetNonblock(fd, true) != nil {
+		_ = syscall.Close(fd)
+		return in, func() {}
+	}
+	restore := func() {
+		if blocking {
+			_ = syscall.SetNonblock(fd, false)
+		}
+	}
+
+	file := os.NewFile(uintptr(fd), f.Name())
+	if err := file.SetReadDeadline(time.Time{}); err != nil {
+		// not pollable, e.g. a regular file, its reads do not block
+		restore()
+		_ = file.Close()
+		return in, func() {}
+	}
+	r := &interruptibleFile{file: file}
+	return r, func() {
+		_ = file.SetReadDeadline(time.Now())
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.stopped = true
+		restore()
+		_ = file.Close()
+	}
+}
+
+// interruptibleFile reads a file until it is stopped.
+type interruptibleFile struct {
+	file    *os.File
+	mutex   sync.Mutex
+	stopped bool
+}
+
+func (r *interruptibleFile) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return 0, stdio.EOF
+	}
+	return r.file.Read(p)
+}
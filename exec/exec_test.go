@@ -23,7 +23,7 @@ func (r *testReader) Read(_p []byte) (int, error) {
 func TestRsync(t *testing.T) {
 	var in = testReader{}
 
-	t.Run("Rsync local to local fail", func(t *testing.T) {
+	t.Run("Rsync local to local same directory skipped", func(t *testing.T) {
 		srcM := &testExecutionContext{
 			host: "localhost",
 		}
@@ -37,7 +37,7 @@ func TestRsync(t *testing.T) {
 
 		err := Rsync(io,
 			srcM, "/workspace/repo1", "build/chart",
-			dstM, "/root/chart",
+			dstM, "/workspace/repo1/",
 			[]string{})
 
 		if err != nil {
@@ -51,9 +51,71 @@ func TestRsync(t *testing.T) {
 		}
 	})
 
-	t.Run("Rsync remote to local fail", func(t *testing.T) {
+	t.Run("Rsync local to local success", func(t *testing.T) {
+		srcM := &testExecutionContext{
+			host: "localhost",
+		}
+		dstM := &testExecutionContext{
+			host: "localhost",
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Rsync(io,
+			srcM, "/workspace/repo1", "build/chart",
+			dstM, "/root/chart",
+			[]string{})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "rsync --archive --relative --delete --verbose -o /workspace/repo1/./build/chart /root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
+
+	t.Run("Rsync remote to local with remote shell", func(t *testing.T) {
 		sm := &testExecutionContext{
+			user:       "remoteuser",
+			host:       "remote",
+			port:       2222,
+			sshOptions: SshCommandOptions{IdentityFile: "/keys/id ed25519"},
+		}
+		dm := &testExecutionContext{
+			host: "localhost",
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Rsync(io,
+			sm, "/workspace/repo1", "build/chart",
+			dm, "/root/chart", []string{"-e", "ssh -o Compression=yes", "--checksum"})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "rsync --archive --relative --delete --verbose -o -e ssh -o Compression=yes -p 2222 -i '/keys/id ed25519' --checksum remoteuser@remote:/workspace/repo1/./build/chart /root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
+
+	t.Run("Rsync remote to local success", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "remoteuser",
 			host: "remote",
+			port: 2222,
 		}
 		dm := &testExecutionContext{
 			host: "localhost",
@@ -67,12 +129,77 @@ func TestRsync(t *testing.T) {
 			sm, "/workspace/repo1", "build/chart",
 			dm, "/root/chart", []string{})
 
-		if err == nil {
-			t.Fatalf("expected error")
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "rsync --archive --relative --delete --verbose -o -e ssh -p 2222 remoteuser@remote:/workspace/repo1/./build/chart /root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
+
+	t.Run("Rsync same host different ports success", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "app",
+			host: "containers",
+			port: 2222,
+		}
+		dm := &testExecutionContext{
+			user: "app",
+			host: "containers",
+			port: 2223,
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Rsync(io,
+			sm, "/data", "chart",
+			dm, "/data", []string{})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "ssh app@containers -p 2222 -- rsync --archive --relative --delete --verbose -o -e ssh -p 2223 /data/./chart app@containers:/data"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
+
+	t.Run("Rsync same remote host success", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "remoteuser",
+			host: "remote",
+		}
+		dm := &testExecutionContext{
+			user: "remoteuser",
+			host: "remote",
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Rsync(io,
+			sm, "/workspace/repo1", "build/chart",
+			dm, "/root/chart", []string{})
+
+		if err != nil {
+			t.Error(err)
 		}
 
-		if err.Error() != "remote machine cannot be localhost" {
-			t.Fatalf("not expected: [%s]", err.Error())
+		result := buffer.String()
+		expected := "ssh remoteuser@remote -- rsync --archive --relative --delete --verbose -o /workspace/repo1/./build/chart /root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
 		}
 	})
 
@@ -168,6 +295,42 @@ func TestRsync(t *testing.T) {
 			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
 		}
 	})
+
+	t.Run("Rsync to non-default port with identity", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "localuser",
+			host: "localhost",
+		}
+		dm := &testExecutionContext{
+			user: "remoteuser",
+			host: "remotehost",
+			port: 2222,
+			sshOptions: SshCommandOptions{
+				IdentityFile:          "/home/user/.ssh/id ed25519",
+				StrictHostKeyChecking: "yes",
+			},
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Rsync(io,
+			sm, "/workspace/repo1", "build/chart",
+			dm, "/root/chart",
+			[]string{})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "rsync --archive --relative --delete --verbose -o -e ssh -p 2222 -i '/home/user/.ssh/id ed25519' -o StrictHostKeyChecking=yes /workspace/repo1/./build/chart remoteuser@remotehost:/root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
 }
 
 func TestScp(t *testing.T) {
@@ -289,4 +452,99 @@ func TestScp(t *testing.T) {
 			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
 		}
 	})
+
+	t.Run("Scp same host different users success", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "srcuser",
+			host: "shared",
+		}
+		dm := &testExecutionContext{
+			user: "dstuser",
+			host: "shared",
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Scp(io,
+			sm, "/workspace/repo1/build/chart",
+			dm, "/root/chart")
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "ssh srcuser@shared -- scp /workspace/repo1/build/chart dstuser@shared:/root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
+
+	t.Run("Scp local to remote non-default port", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "localuser",
+			host: "localhost",
+		}
+		dm := &testExecutionContext{
+			user: "remoteuser",
+			host: "fd00::1",
+			port: 2222,
+			sshOptions: SshCommandOptions{
+				IdentityFile: "/keys/id_rsa",
+			},
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Scp(io,
+			sm, "/workspace/repo1/build/chart",
+			dm, "/root/chart")
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "scp -P 2222 -i /keys/id_rsa /workspace/repo1/build/chart remoteuser@[fd00::1]:/root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
+
+	t.Run("Scp remote to local non-default port", func(t *testing.T) {
+		sm := &testExecutionContext{
+			user: "remoteuser",
+			host: "remotehost",
+			port: 2022,
+		}
+		dm := &testExecutionContext{
+			user: "localuser",
+			host: "localhost",
+		}
+
+		var buffer bytes.Buffer
+		var log bytes.Buffer
+		io := NewCommandInOut(&buffer, &buffer, &log, &in)
+
+		err := Scp(io,
+			sm, "/workspace/repo1/build/chart",
+			dm, "/root/chart")
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		result := buffer.String()
+		expected := "scp -P 2022 remoteuser@remotehost:/workspace/repo1/build/chart /root/chart"
+
+		if result != expected {
+			t.Fatalf("\nexpected:\n[%s]\ngot:\n[%s]\n", expected, result)
+		}
+	})
 }
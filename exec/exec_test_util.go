@@ -1,14 +1,17 @@
 package exec
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type testExecutionContext struct {
-	user string
-	host string
-	port int
+	user       string
+	host       string
+	port       int
+	sshOptions SshCommandOptions
 }
 
 func (rc *testExecutionContext) IsLocal() bool {
@@ -35,6 +38,39 @@ func (rc *testExecutionContext) RunCmd(io CommandInOut, _dir string, command str
 	return nil
 }
 
+// ExecuteCmdContext implements Machine
+func (rc *testExecutionContext) ExecuteCmdContext(_ctx context.Context, io CommandInOut, dir string, command string, arg ...string) (string, error) {
+	return rc.ExecuteCmd(io, dir, command, arg...)
+}
+
+// RunCmdContext implements Machine
+func (rc *testExecutionContext) RunCmdContext(_ctx context.Context, io CommandInOut, dir string, command string, arg ...string) error {
+	return rc.RunCmd(io, dir, command, arg...)
+}
+
+// RunCmdWithResult implements Machine
+func (rc *testExecutionContext) RunCmdWithResult(_ctx context.Context, _io CommandInOut, _dir string, command string, arg ...string) (*CommandResult, error) {
+	cmd := rc.buildCmd(command, arg...)
+	now := time.Now()
+	return &CommandResult{
+		Host:        rc.host,
+		CommandLine: cmd,
+		Stdout:      []byte(cmd),
+		StartTime:   now,
+		EndTime:     now,
+	}, nil
+}
+
+// WithEnv implements Machine
+func (rc *testExecutionContext) WithEnv(_env Env) Machine {
+	return rc
+}
+
+// Close implements Machine
+func (rc *testExecutionContext) Close() error {
+	return nil
+}
+
 // User implements Machine
 func (rc *testExecutionContext) User() string {
 	return rc.user
@@ -55,6 +91,10 @@ func (rc *testExecutionContext) Port() int {
 	return rc.port
 }
 
+func (rc *testExecutionContext) sshCommandOptions() SshCommandOptions {
+	return rc.sshOptions
+}
+
 func (rc *testExecutionContext) buildCmd(command string, arg ...string) string {
 	cmd := buildCmd(command, arg...)
 	if rc.IsLocal() {
@@ -0,0 +1,334 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrTransferNotSupported is returned when a machine cannot provide access to its file system.
+	ErrTransferNotSupported = errors.New("file transfer not supported")
+	// ErrChecksumMismatch is returned when a transferred file differs from its source.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// TransferProgress reports the state of the file being transferred.
+type TransferProgress struct {
+	// Path is the source path of the file.
+	Path        string
+	Transferred int64
+	Size        int64
+}
+
+// TransferOptions configures Copy, Upload and Download.
+type TransferOptions struct {
+	// Progress is called whenever a chunk of a file has been transferred.
+	Progress func(progress TransferProgress)
+	// Verify compares SHA-256 checksums of every source and destination file.
+	Verify bool
+	// Log receives a line for every entry of a directory that is skipped, like symlinked directories.
+	Log io.Writer
+}
+
+// fileSystem is the part of a machine's file system needed to transfer files.
+type fileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Join(elem ...string) string
+}
+
+// fileSystemProvider is implemented by machines providing direct access to their file system.
+type fileSystemProvider interface {
+	fileSystem(ctx context.Context) (fileSystem, func(), error)
+}
+
+func machineFileSystem(ctx context.Context, machine Machine) (fileSystem, func(), error) {
+	provider, ok := machine.(fileSystemProvider)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTransferNotSupported, machine.Host())
+	}
+	return provider.fileSystem(ctx)
+}
+
+func supportsFileTransfer(machine Machine) bool {
+	_, ok := machine.(fileSystemProvider)
+	return ok
+}
+
+// Upload copies a local file or directory tree to the machine.
+func Upload(ctx context.Context, machine Machine, localPath, remotePath string, options TransferOptions) error {
+	return Copy(ctx, NewLocalMachine(""), localPath, machine, remotePath, options)
+}
+
+// Download copies a file or directory tree from the machine to the local file system.
+func Download(ctx context.Context, machine Machine, remotePath, localPath string, options TransferOptions) error {
+	return Copy(ctx, machine, remotePath, NewLocalMachine(""), localPath, options)
+}
+
+// Copy copies a file or directory tree between machines using SFTP for SSH machines.
+// File modes and modification times are preserved. Like scp, when the destination
+// is an existing directory the source is copied into it. Symlinks to files are copied
+// as files, symlinked directories and special files are skipped.
+func Copy(ctx context.Context, sourceMachine Machine, sourcePath string, destinationMachine Machine, destinationPath string, options TransferOptions) error {
+	srcFs, releaseSrc, err := machineFileSystem(ctx, sourceMachine)
+	if err != nil {
+		return err
+	}
+	defer releaseSrc()
+
+	dstFs, releaseDst, err := machineFileSystem(ctx, destinationMachine)
+	if err != nil {
+		return err
+	}
+	defer releaseDst()
+
+	info, err := srcFs.Stat(sourcePath)
+	if err != nil {
+		return fmt.Errorf("%w: cannot read source %s", err, sourcePath)
+	}
+
+	if dstInfo, err := dstFs.Stat(destinationPath); err == nil && dstInfo.IsDir() {
+		destinationPath = dstFs.Join(destinationPath, filepath.Base(sourcePath))
+	}
+
+	t := &transfer{
+		ctx:     ctx,
+		src:     srcFs,
+		dst:     dstFs,
+		options: options,
+	}
+	if info.IsDir() {
+		return t.copyTree(sourcePath, destinationPath, info)
+	}
+	return t.copyFile(sourcePath, destinationPath, info)
+}
+
+type transfer struct {
+	ctx     context.Context
+	src     fileSystem
+	dst     fileSystem
+	options TransferOptions
+}
+
+func (t *transfer) copyTree(sourceDir, destinationDir string, info fs.FileInfo) error {
+	if err := t.dst.MkdirAll(destinationDir); err != nil {
+		return fmt.Errorf("%w: cannot create directory %s", err, destinationDir)
+	}
+
+	entries, err := t.src.ReadDir(sourceDir)
+	if err != nil {
+		return fmt.Errorf("%w: cannot read directory %s", err, sourceDir)
+	}
+
+	for _, entry := range entries {
+		if err := contextError(t.ctx); err != nil {
+			return err
+		}
+		source := t.src.Join(sourceDir, entry.Name())
+		destination := t.dst.Join(destinationDir, entry.Name())
+		switch {
+		case entry.IsDir():
+			err = t.copyTree(source, destination, entry)
+		case entry.Mode().IsRegular():
+			err = t.copyFile(source, destination, entry)
+		default:
+			// symlinks to files are copied as files, symlinked directories are not followed
+			resolved, statErr := t.src.Stat(source)
+			switch {
+			case statErr != nil:
+				t.skip("Skipping %s: %v\n", source, statErr)
+				continue
+			case resolved.IsDir():
+				t.skip("Skipping symlinked directory %s\n", source)
+				continue
+			case !resolved.Mode().IsRegular():
+				t.skip("Skipping special file %s\n", source)
+				continue
+			}
+			err = t.copyFile(source, destination, resolved)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// times are set last, copying the contents modifies them
+	return t.preserve(destinationDir, info)
+}
+
+func (t *transfer) skip(format string, a ...any) {
+	if t.options.Log != nil {
+		_, _ = fmt.Fprintf(t.options.Log, format, a...)
+	}
+}
+
+func (t *transfer) copyFile(source, destination string, info fs.FileInfo) error {
+	reader, err := t.src.Open(source)
+	if err != nil {
+		return fmt.Errorf("%w: cannot open %s", err, source)
+	}
+
+	writer, err := t.dst.Create(destination)
+	if err != nil {
+		_ = reader.Close()
+		return fmt.Errorf("%w: cannot create %s", err, destination)
+	}
+
+	progress := &progressReader{
+		ctx:      t.ctx,
+		reader:   reader,
+		progress: t.options.Progress,
+		state:    TransferProgress{Path: source, Size: info.Size()},
+	}
+	if t.options.Verify {
+		progress.hash = sha256.New()
+	}
+
+	// an SFTP request blocked when ctx is done only returns once its client is closed, it is not waited for
+	copied := make(chan error, 1)
+	go func() {
+		defer reader.Close()
+		_, err := io.Copy(writer, progress)
+		closeErr := writer.Close()
+		if err != nil {
+			copied <- fmt.Errorf("%w: cannot copy %s to %s", err, source, destination)
+		} else if closeErr != nil {
+			copied <- fmt.Errorf("%w: cannot write %s", closeErr, destination)
+		}
+		close(copied)
+	}()
+	select {
+	case err := <-copied:
+		if err != nil {
+			if ctxErr := contextError(t.ctx); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+	case <-t.ctx.Done():
+		return contextError(t.ctx)
+	}
+
+	// verified before the mode is applied, which may not allow reading
+	if t.options.Verify {
+		if err := t.verify(destination, progress.hash.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	return t.preserve(destination, info)
+}
+
+func (t *transfer) preserve(destination string, info fs.FileInfo) error {
+	if err := t.dst.Chmod(destination, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("%w: cannot change mode of %s", err, destination)
+	}
+	if err := t.dst.Chtimes(destination, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("%w: cannot change times of %s", err, destination)
+	}
+	return nil
+}
+
+func (t *transfer) verify(destination string, expected []byte) error {
+	reader, err := t.dst.Open(destination)
+	if err != nil {
+		return fmt.Errorf("%w: cannot open %s", err, destination)
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return fmt.Errorf("%w: cannot read %s", err, destination)
+	}
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, destination)
+	}
+	return nil
+}
+
+// progressReader reports progress and computes the checksum of the data read,
+// it stops reading once ctx is done.
+type progressReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	hash     hash.Hash
+	progress func(progress TransferProgress)
+	state    TransferProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := contextError(r.ctx); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if r.hash != nil {
+			r.hash.Write(p[:n])
+		}
+		r.state.Transferred += int64(n)
+		if r.progress != nil {
+			r.progress(r.state)
+		}
+	}
+	return n, err
+}
+
+// localFileSystem gives access to the file system of the local machine.
+type localFileSystem struct{}
+
+func (localFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFileSystem) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (localFileSystem) MkdirAll(name string) error {
+	return os.MkdirAll(name, 0o755)
+}
+
+func (localFileSystem) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (localFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (localFileSystem) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
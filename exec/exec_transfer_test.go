@@ -0,0 +1,200 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestTree(t *testing.T, root string) {
+	files := map[string]string{
+		"a.txt":         "alpha",
+		"sub/b.txt":     "bravo",
+		"sub/sub/c.txt": string(bytes.Repeat([]byte("charlie"), 10000)),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "a.txt"), 0o751); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertSameTree(t *testing.T, expected, actual string) {
+	err := filepath.Walk(expected, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(expected, path)
+		other, err := os.Stat(filepath.Join(actual, rel))
+		if err != nil {
+			t.Errorf("missing %s: %v", rel, err)
+			return nil
+		}
+		if info.Mode() != other.Mode() {
+			t.Errorf("%s: mode %s != %s", rel, info.Mode(), other.Mode())
+		}
+		if info.IsDir() {
+			return nil
+		}
+		// SFTP transfers modification times with a precision of seconds
+		if !info.ModTime().Truncate(time.Second).Equal(other.ModTime()) {
+			t.Errorf("%s: mtime %s != %s", rel, info.ModTime(), other.ModTime())
+		}
+		a, _ := os.ReadFile(path)
+		b, _ := os.ReadFile(filepath.Join(actual, rel))
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s: content differs", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server := newTestSshServer(t)
+	remote := server.machine()
+	ctx := context.Background()
+
+	source := filepath.Join(t.TempDir(), "tree")
+	writeTestTree(t, source)
+
+	t.Run("Upload and download tree", func(t *testing.T) {
+		uploaded := filepath.Join(t.TempDir(), "uploaded")
+		var transferred int64
+		options := TransferOptions{
+			Verify: true,
+			Progress: func(p TransferProgress) {
+				if p.Transferred > p.Size {
+					t.Errorf("%s: transferred %d of %d", p.Path, p.Transferred, p.Size)
+				}
+				transferred = p.Transferred
+			},
+		}
+		if err := Upload(ctx, remote, source, uploaded, options); err != nil {
+			t.Fatal(err)
+		}
+		assertSameTree(t, source, uploaded)
+		if transferred == 0 {
+			t.Fatalf("progress not reported")
+		}
+
+		downloadDir := t.TempDir()
+		if err := Download(ctx, remote, uploaded, downloadDir, TransferOptions{Verify: true}); err != nil {
+			t.Fatal(err)
+		}
+		// an existing destination directory receives the source
+		assertSameTree(t, source, filepath.Join(downloadDir, "uploaded"))
+	})
+
+	t.Run("Scp local to remote", func(t *testing.T) {
+		destination := filepath.Join(t.TempDir(), "copy.txt")
+
+		var log bytes.Buffer
+		io := NewCommandInOut(nil, nil, &log, nil)
+		if err := Scp(io, NewLocalMachine("test"), filepath.Join(source, "a.txt"), remote, destination); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "alpha" {
+			t.Fatalf("not expected: [%s]", content)
+		}
+		if log.Len() == 0 {
+			t.Fatalf("copy not logged")
+		}
+	})
+
+	t.Run("Copy remote to remote", func(t *testing.T) {
+		destination := filepath.Join(t.TempDir(), "tree")
+		if err := Copy(ctx, remote, source, server.machine(), destination, TransferOptions{Verify: true}); err != nil {
+			t.Fatal(err)
+		}
+		assertSameTree(t, source, destination)
+	})
+
+	t.Run("Symlinked directory skipped", func(t *testing.T) {
+		linked := filepath.Join(t.TempDir(), "tree")
+		writeTestTree(t, linked)
+		if err := os.Symlink(filepath.Join(linked, "sub"), filepath.Join(linked, "link")); err != nil {
+			t.Fatal(err)
+		}
+		destination := filepath.Join(t.TempDir(), "tree")
+
+		var log bytes.Buffer
+		if err := Upload(ctx, remote, linked, destination, TransferOptions{Log: &log}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(destination, "link")); !os.IsNotExist(err) {
+			t.Fatalf("expected link to be skipped: %v", err)
+		}
+		if !strings.Contains(log.String(), "Skipping symlinked directory "+filepath.Join(linked, "link")) {
+			t.Fatalf("not expected: [%s]", log.String())
+		}
+	})
+
+	t.Run("Canceled while blocked", func(t *testing.T) {
+		large := filepath.Join(t.TempDir(), "large")
+		if err := os.WriteFile(large, bytes.Repeat([]byte("x"), 4<<20), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		port, freeze := startFreezingProxy(t, fmt.Sprintf("127.0.0.1:%d", server.port()))
+		machine := NewSshMachine("127.0.0.1", port, server.clientConfig())
+		defer machine.Close()
+
+		canceled, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var once sync.Once
+		options := TransferOptions{
+			Progress: func(TransferProgress) {
+				// the next read is blocked when the context is canceled
+				once.Do(func() {
+					freeze()
+					time.AfterFunc(100*time.Millisecond, cancel)
+				})
+			},
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- Download(canceled, machine, large, filepath.Join(t.TempDir(), "large"), options)
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrCanceled) {
+				t.Fatalf("expected ErrCanceled, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("blocked read not interrupted")
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := Upload(canceled, remote, source, filepath.Join(t.TempDir(), "canceled"), TransferOptions{})
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
@@ -1,32 +1,28 @@
 package exec
 
 import (
+	"context"
+	"errors"
 	"golang.org/x/crypto/ssh"
 	"net"
-	"os"
 )
 
 //goland:noinspection GoUnusedExportedFunction
 func PublicKey(path string) (ssh.AuthMethod, error) {
-	key, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	signer, err := ssh.ParsePrivateKey(key)
+	signer, err := PrivateKey(path, nil)
 	if err != nil {
 		return nil, err
 	}
 	return ssh.PublicKeys(signer), nil
 }
 
-func fileTest(machine Machine, io CommandInOut, fileName string, option string) (bool, error) {
-	err := machine.RunCmd(io, "", "test", option, fileName)
+func fileTest(ctx context.Context, machine Machine, io CommandInOut, fileName string, option string) (bool, error) {
+	err := machine.RunCmdContext(ctx, io, "", "test", option, fileName)
 	if err != nil {
-		switch e := err.(type) {
-		case *ssh.ExitError:
-			if e.ExitStatus() != 0 {
-				return false, nil
-			}
+		// test exits with status 1 when the condition is false, greater than 1 on errors
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) && cmdErr.ExitCode == 1 {
+			return false, nil
 		}
 		return false, err
 	}
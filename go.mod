@@ -2,6 +2,13 @@ module github.com/tfasanga/cmd-exec-go
 
 go 1.21.1
 
-require golang.org/x/crypto v0.20.0
+require (
+	github.com/creack/pty v1.1.21
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/crypto v0.20.0
+	golang.org/x/sys v0.17.0
+	golang.org/x/term v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require golang.org/x/sys v0.17.0 // indirect
+require github.com/kr/fs v0.1.0 // indirect
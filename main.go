@@ -1,16 +1,52 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/tfasanga/cmd-exec-go/exec"
+	"golang.org/x/term"
 	"os"
 )
 
+// Starts an interactive shell, or runs the command on a terminal, on the local machine
+// or on the host alias of ~/.ssh/config:
+//
+//	cmd-exec-go [alias [command [arg...]]]
 func main() {
 	machine := exec.NewLocalMachine("test")
+	if len(os.Args) > 1 {
+		var err error
+		machine, err = exec.NewSshMachineFromConfig(os.Args[1], exec.WithPassphrase(readPassphrase))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	defer machine.Close()
+
+	var command string
+	var args []string
+	if len(os.Args) > 2 {
+		command, args = os.Args[2], os.Args[3:]
+	}
+
 	inOut := exec.NewCommandInOut(os.Stdout, os.Stderr, nil, os.Stdin)
-	err := machine.RunCmd(inOut, "", "ls", "-l")
+	err := exec.RunInteractive(context.Background(), machine, inOut, exec.TerminalOptions{}, "", command, args...)
 	if err != nil {
-		println(err)
+		_ = machine.Close()
+		var cmdErr *exec.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.ExitCode > 0 {
+			os.Exit(cmdErr.ExitCode)
+		}
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
+
+// readPassphrase asks for the passphrase of an encrypted identity file on the terminal.
+func readPassphrase(path string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", path)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}